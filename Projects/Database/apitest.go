@@ -8,6 +8,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 )
 
 const (
@@ -15,21 +18,49 @@ const (
 )
 
 var (
-	apiKey = "test"
+	// issue one with: go run . apikey create -user <name>
+	apiKey = os.Getenv("URLSHORTENER_API_KEY")
 )
 
 func main() {
-	operationPtr := flag.String("op", "shorten", "Choose: shorten, info, test")
+	operationPtr := flag.String("op", "shorten", "Choose: shorten, info, qr, export, test")
 	urlPtr := flag.String("url", "", "URL to shorten or get info for")
 	customNamePtr := flag.String("custom", "", "(Optional) Custom name for shortened URL")
 	expiresInPtr := flag.String("expires", "24h", "(Optional) Expiration time for shortened URL")
+	keyPtr := flag.String("key", "", "(Optional) API key, defaults to $URLSHORTENER_API_KEY")
+	formatPtr := flag.String("format", "", "(Optional) QR format: txt, svg, png; defaults to txt for qr and png for export")
+	sizePtr := flag.String("size", "", "(Optional) QR size in pixels for -op qr and export")
+	outPtr := flag.String("out", "", "(Optional) File to write the QR code to, defaults to stdout, or qr-export.zip for export")
+	codesPtr := flag.String("codes", "", "(Optional) Comma separated short codes for -op export")
+	ownerPtr := flag.String("owner", "", "(Optional) Export every active link of this user for -op export")
 
 	flag.Parse()
 
+	if *keyPtr != "" {
+		apiKey = *keyPtr
+	}
+
 	if *operationPtr == "test" {
 		testErrorCases()
 		return
 	}
+	if *operationPtr == "export" {
+		if *formatPtr == "" {
+			*formatPtr = "png"
+		}
+		if *outPtr == "" {
+			*outPtr = "qr-export.zip"
+		}
+		var codes []string
+		if *codesPtr != "" {
+			codes = strings.Split(*codesPtr, ",")
+		}
+		if err := exportQRCodes(codes, *ownerPtr, *formatPtr, *sizePtr, *outPtr); err != nil {
+			log.Fatalf("Error exporting QR codes: %v", err)
+		}
+		fmt.Printf("QR codes written to %s\n", *outPtr)
+		return
+	}
 	if *urlPtr == "" {
 		log.Fatal("URL is required")
 	}
@@ -49,6 +80,24 @@ func main() {
 		}
 		fmt.Printf("URL Info: %+v\n", urlInfo)
 
+	case "qr":
+		if *formatPtr == "" {
+			*formatPtr = "txt"
+		}
+		// a txt code printed to the terminal gets explicit colors so it scans on dark backgrounds
+		qr, err := getQRCode(*urlPtr, *formatPtr, *sizePtr, *formatPtr == "txt" && *outPtr == "")
+		if err != nil {
+			log.Fatalf("Error getting QR code: %v", err)
+		}
+		if *outPtr == "" {
+			_, err = os.Stdout.Write(qr)
+		} else {
+			err = os.WriteFile(*outPtr, qr, 0644)
+		}
+		if err != nil {
+			log.Fatalf("Error writing QR code: %v", err)
+		}
+
 	default:
 		log.Fatalf("Unknown operation: %s", *operationPtr)
 	}
@@ -140,6 +189,78 @@ func getURLInfo(shortURL string) (map[string]interface{}, error) {
 	return result, nil
 }
 
+func getQRCode(shortURL, format, size string, ansi bool) ([]byte, error) {
+	query := url.Values{"code": {strings.TrimPrefix(shortURL, baseURL+"/")}, "format": {format}}
+	if size != "" {
+		query.Set("size", size)
+	}
+	if ansi {
+		query.Set("ansi", "1")
+	}
+	resp, err := http.Get(baseURL + "/qr?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+
+		}
+	}(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("QR request failed with status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func exportQRCodes(codes []string, owner, format, size, out string) error {
+	payload, err := json.Marshal(map[string]any{"codes": codes, "owner": owner})
+	if err != nil {
+		return err
+	}
+	query := url.Values{"format": {format}}
+	if size != "" {
+		query.Set("size", size)
+	}
+	req, err := http.NewRequest("POST", baseURL+"/api/v1/qr/export?"+query.Encode(), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func testErrorCases() {
 	fmt.Println("Running error case tests...")
 
@@ -3,175 +3,170 @@ package main
 // will use github.com/skip2/go-qrcode for qr implementation
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/skip2/go-qrcode"
-	"math/rand"
 	_ "modernc.org/sqlite"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
-var store = NewURLStore()
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
-
-type URLStore struct {
-	mappings map[string]URLRecord
-	mutex    sync.RWMutex
-}
+var store URLStore
 
 type URLRecord struct {
 	LongURL    string
+	NotBefore  time.Time // zero means live from creation, before it visits get the link's pending page
 	ExpiresAt  time.Time
 	CustomName string
 	Clicks     int
+	CreatedAt  time.Time
+	UserID     int64
+	MaxClicks  int // 0 means unlimited, otherwise the link is archived by the click that reaches it
+	Options    LinkOptions
 }
 
-var err error
-
 func init() {
 	fmt.Println("URL Shortener starting...")
 }
 
 func main() {
-	//fmt.Println("URL Shortener started")
-	//err := initDB()
-	//if err != nil {
-	//	fmt.Printf("Error initializing database: %s\n", err)
-	//	return
-	//}
-	//defer func(db *sql.DB) {
-	//	err := db.Close()
-	//	if err != nil {
-	//		fmt.Printf("Error closing database: %v\n", err)
-	//	}
-	//}(db)
-
-	http.HandleFunc("/", handleRedirect)
-	http.HandleFunc("/home", handleHome)
-	http.HandleFunc("/shorten", referrerCheck(handleShorten))
-	http.HandleFunc("/URLShortener.css", serveCSS)
-	http.HandleFunc("/qr", handleQRCode)
-	http.HandleFunc("/clicks/", handleGetClicks)
-
-	http.HandleFunc("/api/shorten", apiKeyMiddleware(handleAPIShorten))
-	http.HandleFunc("/api/url", apiKeyMiddleware(handleAPIGetURL))
-	http.HandleFunc("/api/docs", handleAPIDocs)
-
-	port := ":8080"
-
-	fmt.Printf("Server starting on port %s\n", port)
-
-	err = http.ListenAndServe(port, nil)
+	var err error
+	config, err = loadConfig()
 	if err != nil {
-		fmt.Printf("Error starting server: %s\n", err)
+		fmt.Printf("Error loading configuration: %v\n", err)
+		os.Exit(2)
+	}
+	webLimiter = rateLimiterFor(config.RateWeb)
+	apiLimiter = rateLimiterFor(config.RateAPI)
+	redirectLimiter = rateLimiterFor(config.RateRedirect)
+	unlockLimiter = rateLimiterFor(config.RateUnlock)
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error running migrations: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	//prolly want every hour but for testing do every 5 mins
-	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			store.cleanupExpiredLinks()
+
+	// set on failure and applied last, after the deferred closes below have run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
 		}
 	}()
-}
 
-func serveCSS(w http.ResponseWriter, r *http.Request) {
-	path, _ := filepath.Abs("Projects/static/URLShortener.css")
-	content, err := os.ReadFile(path)
+	fmt.Println("URL Shortener started")
+	printConfig(config)
+	// the database is opened for every backend, users and API keys always live there
+	err = initDB()
 	if err != nil {
-		fmt.Printf("Error reading CSS file: %v\n", err)
-		http.Error(w, "Could not read CSS file", http.StatusInternalServerError)
+		fmt.Printf("Error initializing database: %s\n", err)
+		exitCode = 1
 		return
 	}
-	//fmt.Printf("CSS file size: %d bytes\n", len(content))
-	w.Header().Set("Content-Type", "text/css")
-	_, err = w.Write(content)
-	if err != nil {
-		fmt.Printf("Error writing CSS response: %v\n", err)
-		http.Error(w, "Error writing CSS response", http.StatusInternalServerError)
-	}
-}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("Error closing database: %v\n", err)
+		}
+	}()
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
-	// :heart: jetbrains mono
-	store.mutex.RLock()
-	urlList := make([]struct {
-		ShortCode string
-		LongURL   string
-		Clicks    int
-		ExpiresAt time.Time
-	}, 0, len(store.mappings))
+	if flag.Arg(0) == "apikey" {
+		if err := runAPIKeyCommand(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exitCode = 1
+		}
+		return
+	}
 
-	now := time.Now()
-	for shortCode, record := range store.mappings {
-		if now.Before(record.ExpiresAt) {
-			urlList = append(urlList, struct {
-				ShortCode string
-				LongURL   string
-				Clicks    int
-				ExpiresAt time.Time
-			}{shortCode, record.LongURL, record.Clicks, record.ExpiresAt})
+	// without a salt the short IP hashes could be reversed by hashing every IPv4 address
+	if config.IPHashSalt == "" {
+		if config.IPHashSalt, err = storedSecret("ip-salt"); err != nil {
+			fmt.Printf("Error loading the IP hash salt: %s\n", err)
+			exitCode = 1
+			return
 		}
 	}
-	store.mutex.RUnlock()
-
-	html := `
-    <!DOCTYPE html>
-    <html>
-    <head>
-        <title>URL Shortener</title>
-        <link rel="stylesheet" href="https://fonts.googleapis.com/css2?family=JetBrains+Mono&display=swap">
-        <link rel="stylesheet" href="/URLShortener.css">
-    </head>
-    <body>
-        <h1>URL Shortener</h1>
-        <form action="/shorten" method="post">
-            <input type="text" name="url" placeholder="Enter URL to shorten" required>
-            <input type="text" name="expires_in" placeholder="Expiration (e.g., 24h)" optional>
-            <input type="text" name="custom_name" placeholder="Custom name (optional)">
-            <input type="submit" value="Shorten">
-        </form>
-        <h2>Shortened URLs</h2>
-        <table>
-            <tr>
-                <th>Short URL</th>
-                <th>Original URL</th>
-                <th>Clicks</th>
-                <th>QR Code</th>
-            </tr>
-    `
 
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	store, err = openStore(config.Store, config.LogPath)
+	if err != nil {
+		fmt.Printf("Error opening %s store: %s\n", config.Store, err)
+		exitCode = 1
+		return
 	}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			fmt.Printf("Error closing store: %v\n", err)
+		}
+	}()
+
+	http.HandleFunc("/", rateLimitByIP(redirectLimiter, handleRedirect))
+	http.HandleFunc("/home", handleHome)
+	http.HandleFunc("/shorten", rateLimitByIP(webLimiter, csrfProtect(handleShorten)))
+	http.HandleFunc("/static/", handleStatic)
+	http.HandleFunc("/URLShortener.css", serveCSS)
+	http.HandleFunc("/qr", handleQRCode)
+	http.HandleFunc("/clicks/", handleGetClicks)
+
+	http.HandleFunc("/api/shorten", apiKeyMiddleware(scope(scopeCreate), handleAPIShorten))
+	http.HandleFunc("/api/url", apiKeyMiddleware(scope(scopeRead), handleAPIGetURL))
+	http.HandleFunc("/api/stats", apiKeyMiddleware(scope(scopeStats), handleAPIStats))
+	http.HandleFunc("/api/v1/links", apiKeyMiddleware(linkScopes, handleAPILinks))
+	http.HandleFunc("/api/v1/links/", apiKeyMiddleware(linkScopes, handleAPILink))
+	http.HandleFunc("/api/v1/links/batch", apiKeyMiddleware(linkScopes, handleAPIBatch))
+	http.HandleFunc("/api/v1/qr/export", apiKeyMiddleware(scope(scopeRead), handleQRExport))
+	http.HandleFunc("/api/v1/keys", apiKeyMiddleware(scope(scopeKeys), handleAPIKeys))
+	http.HandleFunc("/api/v1/keys/", apiKeyMiddleware(scope(scopeKeys), handleAPIKeys))
+	http.HandleFunc("/api/docs", handleAPIDocs)
 
-	for _, url := range urlList {
-		qrURL := fmt.Sprintf("%s://%s/qr?code=%s", scheme, r.Host, url.ShortCode)
-		html += fmt.Sprintf(`
-            <tr>
-                <td><a href="/%s">%s</a></td>
-                <td>%s</td>
-                <td>%d</td>
-                <td><a href="%s" target="_blank">View QR</a></td>
-            </tr>
-        `, url.ShortCode, url.ShortCode, url.LongURL, url.Clicks, qrURL)
+	clickLog = newClickRecorder()
+	qrCodes = newQRCache(config.QRCacheSize)
+	jobs := newScheduler()
+	jobs.Every("expiry-sweep", config.CleanupInterval, sweepExpiredLinks)
+
+	if err := runServer(jobs); err != nil {
+		exitCode = 1
+		return
 	}
+	fmt.Println("Server stopped")
+}
 
-	html += `
-        </table>
-    </body>
-    </html>
-    `
+func handleHome(w http.ResponseWriter, r *http.Request) {
+	// :heart: jetbrains mono
+	urlList, _, err := store.List(LinkFilter{State: linkStateActive})
+	if err != nil {
+		fmt.Printf("Error listing URLs: %v\n", err)
+		http.Error(w, "Error loading URLs", http.StatusInternalServerError)
+		return
+	}
 
-	_, err := fmt.Fprint(w, html)
+	token, err := csrfToken(w, r)
 	if err != nil {
+		fmt.Printf("Error creating CSRF token: %v\n", err)
 		http.Error(w, "Error generating response", http.StatusInternalServerError)
+		return
 	}
+
+	page := homePage{CSRFToken: token, Links: make([]homeRow, 0, len(urlList))}
+	for _, link := range urlList {
+		// anyone can open the page, a click here would use up a limited link or hint at a protected one
+		if link.MaxClicks > 0 || link.Options.PasswordHash != "" {
+			continue
+		}
+		page.Links = append(page.Links, homeRow{
+			ShortCode: link.ShortCode,
+			LongURL:   link.LongURL,
+			Clicks:    link.Clicks,
+			QRURL:     qrURLFor(r, link.ShortCode),
+		})
+	}
+	renderPage(w, "home", page)
 }
 
 func handleShorten(w http.ResponseWriter, r *http.Request) {
@@ -195,7 +190,7 @@ func handleShorten(w http.ResponseWriter, r *http.Request) {
 
 	expirationStr := r.FormValue("expires_in")
 	//fmt.Println(expirationStr)
-	var expiresIn = 24 * time.Hour //for testing change ltr to 24hrs maybe
+	var expiresIn = config.DefaultExpiry
 	if expirationStr != "" {
 		var err error
 		expiresIn, err = time.ParseDuration(expirationStr)
@@ -214,49 +209,33 @@ func handleShorten(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	shortCode = store.Save(longURL, expiresIn, customName)
-
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
-	}
-	shortURL := fmt.Sprintf("%s://%s/%s", scheme, r.Host, shortCode)
-	qrURL := fmt.Sprintf("%s://%s/qr?code=%s", scheme, r.Host, shortCode)
-
-	html := fmt.Sprintf(`
-    <!DOCTYPE html>
-    <html>
-    <head>
-        <title>URL Shortened</title>
-        <link rel="stylesheet" href="https://fonts.googleapis.com/css2?family=JetBrains+Mono&display=swap">
-        <link rel="stylesheet" href="/URLShortener.css">
-    </head>
-    <body>
-        <h1>URL Shortened</h1>
-        <p>Shortened URL: <a href="%s">%s</a></p>
-        <p>Clicks: <span id="clicks">0</span></p>
-        <p>QR Code: <a href="%s" target="_blank">View QR Code</a></p>
-        <img src="%s" alt="QR Code" width="200" height="200">
-        <br>
-        <a href="/">Go Back</a>
-        <script>
-        function updateClicks() {
-            fetch('/clicks/%s')
-                .then(response => response.json())
-                .then(data => {
-                    document.getElementById('clicks').textContent = data.clicks;
-                });
-        }
-        setInterval(updateClicks, 5000);
-        updateClicks(); 
-        </script>
-    </body>
-    </html>
-    `, shortURL, shortURL, qrURL, qrURL, shortCode)
-	_, err := fmt.Fprint(w, html)
+	passwordHash, err := hashLinkPassword(r.FormValue("password"))
 	if err != nil {
-		http.Error(w, "Error generating response", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shortCode, err = store.Save(NewLink{
+		LongURL:    longURL,
+		ExpiresIn:  expiresIn,
+		CustomName: customName,
+		Options:    LinkOptions{PasswordHash: passwordHash},
+	})
+	if errors.Is(err, errCodeTaken) {
+		http.Error(w, "Custom name already in use", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error saving URL: %v\n", err)
+		http.Error(w, "Error saving URL", http.StatusInternalServerError)
+		return
 	}
+
+	renderPage(w, "shortened", shortenedPage{
+		ShortCode: shortCode,
+		ShortURL:  shortURLFor(r, shortCode),
+		QRURL:     qrURLFor(r, shortCode),
+	})
 }
 
 func handleRedirect(w http.ResponseWriter, r *http.Request) {
@@ -265,33 +244,114 @@ func handleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shortCode := r.URL.Path[1:]
-	store.mutex.RLock()
-	record, exists := store.mappings[shortCode]
-	store.mutex.RUnlock()
+	shortCode, rest := r.URL.Path[1:], ""
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		// a prefix link also answers for every path below its code
+		code, tail, found := strings.Cut(r.URL.EscapedPath()[1:], "/")
+		if code, err := url.PathUnescape(code); found && err == nil {
+			if prefixed, ok := store.Lookup(code); ok && prefixed.Options.Prefix {
+				shortCode, rest, record, exists = code, tail, prefixed, true
+			}
+		}
+	}
 
 	if !exists {
-		http.NotFound(w, r)
+		handleGone(w, r)
 		return
 	}
 
-	if time.Now().After(record.ExpiresAt) {
-		store.mutex.Lock()
-		delete(store.mappings, shortCode)
-		store.mutex.Unlock()
-		http.NotFound(w, r)
+	// expired links stay in the store for the grace period so owners can renew them
+	now := time.Now()
+	if now.Before(record.NotBefore) || now.After(record.ExpiresAt) {
+		handleUnavailable(w, r, record, now.After(record.ExpiresAt))
+		return
+	}
+
+	if record.Options.PasswordHash != "" {
+		// the unlock cookie is per browser, so neither the page nor the redirect may be shared by caches
+		w.Header().Set("Cache-Control", "no-store")
+		if !unlocked(r, shortCode, record.Options.PasswordHash) {
+			handleUnlock(w, r, shortCode, record.Options.PasswordHash)
+			return
+		}
+	}
+
+	destination, err := record.Options.destination(record.LongURL, rest, r)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	count, err := store.IncrementClicks(shortCode)
+	switch {
+	case errors.Is(err, errLinkNotFound):
+		// another visit used the last click of a limited link since the lookup
+		handleGone(w, r)
+		return
+	case err != nil && record.MaxClicks > 0:
+		// a limited link only redirects once its click is safely counted
+		fmt.Printf("Error incrementing clicks for %s: %v\n", shortCode, err)
+		http.Error(w, "Error loading URL", http.StatusInternalServerError)
+		return
+	case err != nil:
+		fmt.Printf("Error incrementing clicks for %s: %v\n", shortCode, err)
+	default:
+		clickStreams.Publish(shortCode, count)
+	}
+	clickLog.Record(newClickEvent(shortCode, r))
+	status := record.Options.redirectStatus()
+	if record.Options.PasswordHash == "" {
+		setRedirectCaching(w, record, status, now)
+	}
+	http.Redirect(w, r, destination, status)
+}
+
+// maxRedirectCacheAge bounds how long a browser may skip the server for a permanent redirect,
+// so changed destinations and click counting catch up eventually
+const maxRedirectCacheAge = 24 * time.Hour
+
+// setRedirectCaching keeps 301 and 308, which browsers cache forever by default, from outliving the link:
+// limited links must reach the server on every visit, others at most until they expire
+func setRedirectCaching(w http.ResponseWriter, record URLRecord, status int, now time.Time) {
+	if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+		return
+	}
+	if record.MaxClicks > 0 {
+		w.Header().Set("Cache-Control", "no-store")
 		return
 	}
+	maxAge := min(record.ExpiresAt.Sub(now), maxRedirectCacheAge)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+}
 
-	store.IncrementClicks(shortCode)
-	http.Redirect(w, r, record.LongURL, http.StatusFound)
+// handleGone answers for a code that doesn't resolve: archived links, swept after the grace period or
+// used up, keep their expired page and expired_url, anything else is a 404
+func handleGone(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.URL.Path[1:]
+	record, archived := store.LookupArchived(shortCode)
+	if !archived {
+		code, _, found := strings.Cut(r.URL.EscapedPath()[1:], "/")
+		if code, err := url.PathUnescape(code); found && err == nil {
+			if prefixed, ok := store.LookupArchived(code); ok && prefixed.Options.Prefix {
+				record, archived = prefixed, true
+			}
+		}
+	}
+	if !archived {
+		http.NotFound(w, r)
+		return
+	}
+	handleUnavailable(w, r, record, true)
 }
 
 func handleGetClicks(w http.ResponseWriter, r *http.Request) {
 	shortCode := r.URL.Path[len("/clicks/"):]
-	store.mutex.RLock()
-	record, exists := store.mappings[shortCode]
-	store.mutex.RUnlock()
+	if code, ok := strings.CutSuffix(shortCode, "/stream"); ok {
+		handleClickStream(w, r, code)
+		return
+	}
+	record, exists := store.Lookup(shortCode)
 
 	if !exists {
 		http.NotFound(w, r)
@@ -315,6 +375,8 @@ func handleAPIShorten(w http.ResponseWriter, r *http.Request) {
 		LongURL    string `json:"long_url"`
 		CustomName string `json:"custom_name,omitempty"`
 		ExpiresIn  string `json:"expires_in,omitempty"`
+		Password   string `json:"password,omitempty"`
+		clickLimitInput
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -334,16 +396,47 @@ func handleAPIShorten(w http.ResponseWriter, r *http.Request) {
 
 	expiresIn, err := time.ParseDuration(input.ExpiresIn)
 	if err != nil {
-		expiresIn = 24 * time.Hour
+		expiresIn = config.DefaultExpiry
+	}
+
+	if input.CustomName != "" && !store.IsCustomNameAvailable(input.CustomName) {
+		http.Error(w, "Custom name already in use", http.StatusBadRequest)
+		return
 	}
 
-	shortCode := store.Save(input.LongURL, expiresIn, input.CustomName)
+	passwordHash, err := hashLinkPassword(input.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxClicks, err := input.maxClicks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxClicks == nil {
+		maxClicks = new(int)
+	}
 
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	shortCode, err := store.Save(NewLink{
+		LongURL:    input.LongURL,
+		ExpiresIn:  expiresIn,
+		CustomName: input.CustomName,
+		UserID:     keyFromContext(r).UserID,
+		MaxClicks:  *maxClicks,
+		Options:    LinkOptions{PasswordHash: passwordHash},
+	})
+	if errors.Is(err, errCodeTaken) {
+		http.Error(w, "Custom name already in use", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error saving URL: %v\n", err)
+		http.Error(w, "Error saving URL", http.StatusInternalServerError)
+		return
 	}
-	shortURL := fmt.Sprintf("%s://%s/%s", scheme, r.Host, shortCode)
+
+	shortURL := shortURLFor(r, shortCode)
 
 	response := struct {
 		ShortURL string `json:"short_url"`
@@ -370,14 +463,16 @@ func handleAPIGetURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	store.mutex.RLock()
-	record, exists := store.mappings[shortCode]
-	store.mutex.RUnlock()
+	record, exists := store.Lookup(shortCode)
 
 	if !exists || time.Now().After(record.ExpiresAt) {
 		http.NotFound(w, r)
 		return
 	}
+	if !readsLink(r, record) {
+		http.Error(w, "Forbidden: only the owner can see this link", http.StatusForbidden)
+		return
+	}
 
 	response := struct {
 		LongURL    string `json:"long_url"`
@@ -402,19 +497,81 @@ func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
 	docs := `
     API Documentation:
 
+    API keys belong to a user and carry scopes: create, read, update, delete, stats, keys
+    Issue the first one from the shell: go run . apikey create -user <name> [-scopes create,read] [-expires 720h]
+
     1. Shorten URL
        Endpoint: POST /api/shorten
        Headers: X-API-Key: your-secret-api-key
        Body: {
            "long_url": "https://example.com",
            "custom_name": "optional-custom-name",
-           "expires_in": "24h" // put in any time ie. 24h, 1h, 30m, 1s
+           "expires_in": "24h", // put in any time ie. 24h, 1h, 30m, 1s
+           "password": "optional, 4 to 72 characters",
+           "max_clicks": 10 // optional, or "one_time": true for a single visit
        }
 
     2. Get URL Info
        Endpoint: GET /api/url?code=<short_code>
        Headers: X-API-Key: your-secret-api-key
 
+    3. Click Stats
+       Endpoint: GET /api/stats?code=<short_code>&bucket=day // bucket is hour, day or week
+       Headers: X-API-Key: your-secret-api-key
+       Returns clicks per bucket, top referrers, top user agents and an estimate of unique visitors,
+       archived links included
+
+    4. Links (v1)
+       All v1 endpoints take X-API-Key and answer in JSON, errors as {"error": "..."}
+       A key only lists, changes and deletes links of its own user; links made without a key
+       can be read (unless password protected) but not changed
+       GET    /api/v1/links?limit=50&offset=0&prefix=ab&state=active|scheduled|expired|archived|all&created_after=2024-01-01&created_before=...
+       POST   /api/v1/links           body like /api/shorten
+       GET    /api/v1/links/<code>
+       PATCH  /api/v1/links/<code>    body: {"long_url": "...", "expires_in": "48h" or "expires_at": "RFC3339", "custom_name": "new-code"}
+       DELETE /api/v1/links/<code>
+       POST   /api/v1/links/<code>/renew  body: {"expires_in": "24h"}, only for the owner of the link
+       PUT    /api/v1/links/<code>/logo   body: PNG, JPEG or GIF up to 256 KB and 1024x1024, only for the owner
+       GET    /api/v1/links/<code>/logo
+       DELETE /api/v1/links/<code>/logo
+       A link with a logo gets it in the middle of its PNG and SVG QR codes at level H;
+       /qr takes logo_scale=5..50 (percent of the code width, default 20) or logo=0 for a plain code
+       POST and PATCH also take "redirect_status": 301 | 302 | 307 | 308 (default 302) and
+       "forward_query": "off" | "keep" | "override" | "append" to pass the visitor's query string on;
+       for keys the destination already has, keep sends the destination's value, override the
+       visitor's and append both
+       "prefix": true makes /<code>/any/path redirect to the destination with /any/path appended
+       "password": "..." makes visitors unlock the link first, "" removes it; responses only say "password_protected"
+       "max_clicks": n archives the link on its nth visit ("one_time": true is max_clicks 1), 0 removes the limit;
+       PATCH refuses a limit the link has already reached
+       "not_before": "RFC3339" keeps the link from going live until then ("" in PATCH makes it live now);
+       visitors get a "not live yet" page before that and an "expired" page afterwards, "pending_message"
+       and "expired_message" replace their text and "pending_url" / "expired_url" redirect there instead
+       Renaming a link with custom_name keeps its clicks and click history
+       Expired links can be renewed until the grace period (-expiry-grace) is over, then they are archived
+
+    5. Bulk Shorten (v1)
+       Endpoint: POST /api/v1/links/batch
+       Headers: X-API-Key: your-secret-api-key
+       Body: [{"long_url": "...", "custom_name": "...", "expires_in": "24h"}, ...] // up to 5000 links
+       Valid links are created together, the response has one result per item in order with
+       either "short_url" or "error": {"code": "invalid" | "name_taken", "message": "..."}
+
+    6. API Keys (v1), the calling key needs the keys scope
+       GET    /api/v1/keys              keys of the calling key's user, never the key itself
+       POST   /api/v1/keys              body: {"name": "ci", "scopes": ["create", "read"], "expires_in": "720h"}
+                                        returns the new key once, scopes are limited to the caller's own and
+                                        the lifetime to the caller's, a key that expires cannot create one that never does
+       DELETE /api/v1/keys/<id>         revoke, only keys whose scopes the caller also has
+
+    7. QR Export (v1)
+       Endpoint: POST /api/v1/qr/export?size=1024&level=H&format=png // takes the same options as /qr
+       Headers: X-API-Key: your-secret-api-key
+       Body: {"codes": ["abc", "def"]} or {"owner": "username", "state": "active" | "expired" | "all"}
+       Codes and owner are limited to the calling key's user
+       Returns a ZIP with one QR code per link (up to 1000) and manifest.csv mapping
+       file names to short codes, short URLs and destinations
+
     `
 
 	w.Header().Set("Content-Type", "text/plain")
@@ -424,84 +581,6 @@ func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NewURLStore() *URLStore {
-	return &URLStore{
-		mappings: make(map[string]URLRecord),
-	}
-}
-
-func generateShortCode() string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	shortCode := make([]byte, 6)
-	for i := range shortCode {
-		shortCode[i] = charset[seededRand.Intn(len(charset))]
-	}
-	return string(shortCode)
-}
-
-func (store *URLStore) Get(shortCode string) (string, bool) {
-	store.mutex.RLock()
-	defer store.mutex.RUnlock()
-
-	record, exists := store.mappings[shortCode]
-	if !exists || time.Now().After(record.ExpiresAt) {
-		return "", false
-	}
-	return record.LongURL, true
-}
-
-func (store *URLStore) Save(longURL string, expiresIn time.Duration, customName string) string {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-
-	var shortCode string
-	if customName != "" {
-		shortCode = customName
-	} else {
-		for {
-			shortCode = generateShortCode()
-			if _, exists := store.mappings[shortCode]; !exists {
-				break
-			}
-		}
-	}
-
-	store.mappings[shortCode] = URLRecord{
-		LongURL:    longURL,
-		ExpiresAt:  time.Now().Add(expiresIn),
-		CustomName: customName,
-	}
-	return shortCode
-}
-
-func (store *URLStore) IsCustomNameAvailable(name string) bool {
-	store.mutex.RLock()
-	defer store.mutex.RUnlock()
-	_, exists := store.mappings[name]
-	return !exists
-}
-
-func (store *URLStore) IncrementClicks(shortCode string) {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-	if record, exists := store.mappings[shortCode]; exists {
-		record.Clicks++
-		store.mappings[shortCode] = record
-	}
-}
-
-func (store *URLStore) cleanupExpiredLinks() {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-
-	now := time.Now()
-	for shortCode, record := range store.mappings {
-		if now.After(record.ExpiresAt) {
-			delete(store.mappings, shortCode)
-		}
-	}
-}
-
 func isValidURL(rawURL string) bool {
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
@@ -509,64 +588,3 @@ func isValidURL(rawURL string) bool {
 	}
 	return parsedURL.Scheme != "" && parsedURL.Host != ""
 }
-
-func handleQRCode(w http.ResponseWriter, r *http.Request) {
-	shortCode := r.URL.Query().Get("code")
-	if shortCode == "" {
-		http.Error(w, "Missing short code", http.StatusBadRequest)
-		return
-	}
-
-	store.mutex.RLock()
-	_, exists := store.mappings[shortCode]
-	store.mutex.RUnlock()
-
-	if !exists {
-		http.NotFound(w, r)
-		return
-	}
-
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
-	}
-	fullURL := fmt.Sprintf("%s://%s/%s", scheme, r.Host, shortCode)
-
-	qr, err := qrcode.Encode(fullURL, qrcode.Medium, 256)
-	if err != nil {
-		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "image/png")
-	_, err = w.Write(qr)
-	if err != nil {
-		return
-	}
-}
-
-// use in /api/... maybe
-func apiKeyMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != "test" { // temp for testing
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-}
-
-func referrerCheck(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/shorten" {
-			referer := r.Header.Get("Referer")
-			if !strings.HasPrefix(referer, "http://localhost:8080/") &&
-				!strings.HasPrefix(referer, "https://localhost:8080/") {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
-			}
-		}
-		next.ServeHTTP(w, r)
-	}
-}
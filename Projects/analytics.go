@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClickEvent is one redirect through a short link
+type ClickEvent struct {
+	ShortCode      string    `json:"code"`
+	At             time.Time `json:"at"`
+	Referrer       string    `json:"referrer,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	IPHash         string    `json:"ip_hash,omitempty"`
+	AcceptLanguage string    `json:"accept_language,omitempty"`
+}
+
+const topListSize = 10
+
+func newClickEvent(shortCode string, r *http.Request) ClickEvent {
+	return ClickEvent{
+		ShortCode:      shortCode,
+		At:             time.Now().UTC(),
+		Referrer:       r.Referer(),
+		UserAgent:      r.UserAgent(),
+		IPHash:         hashIP(clientIP(r)),
+		AcceptLanguage: r.Header.Get("Accept-Language"),
+	}
+}
+
+// clientIP is the connecting address, unless that is a trusted proxy: then X-Forwarded-For is read
+// from the right, where each proxy appended the address it saw, up to the first hop that isn't trusted.
+// Anything left of that hop came from the client and could be forged.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range config.TrustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads "10.0.0.1, 192.168.0.0/16, ::1", a bare address trusts only itself
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy %q", field)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q", field)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func hashIP(ip string) string {
+	// the salt keeps stored hashes from being reversed by hashing every IPv4 address, main makes
+	// sure there always is one
+	sum := sha256.Sum256([]byte(config.IPHashSalt + ip))
+	return hex.EncodeToString(sum[:8])
+}
+
+type bucketCount struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+type rankedValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type clickStats struct {
+	Code           string        `json:"code"`
+	TotalClicks    int           `json:"total_clicks"`
+	UniqueVisitors int           `json:"unique_visitors"`
+	Bucket         string        `json:"bucket"`
+	Buckets        []bucketCount `json:"buckets"`
+	TopReferrers   []rankedValue `json:"top_referrers"`
+	TopUserAgents  []rankedValue `json:"top_user_agents"`
+}
+
+// bucketStart truncates t (UTC) to the start of its hour, day or ISO week
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		offset := (int(day.Weekday()) + 6) % 7 // monday is the first day
+		return day.AddDate(0, 0, -offset)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func computeStats(shortCode, bucket string, events []ClickEvent) clickStats {
+	stats := clickStats{
+		Code:        shortCode,
+		TotalClicks: len(events),
+		Bucket:      bucket,
+	}
+
+	buckets := make(map[time.Time]int)
+	referrers := make(map[string]int)
+	userAgents := make(map[string]int)
+	visitors := make(map[string]struct{})
+	for _, event := range events {
+		buckets[bucketStart(event.At, bucket)]++
+		referrer := event.Referrer
+		if referrer == "" {
+			referrer = "(direct)"
+		}
+		referrers[referrer]++
+		if event.UserAgent != "" {
+			userAgents[event.UserAgent]++
+		}
+		// hashed IP + user agent is only an estimate, NAT and proxies make it undercount
+		visitors[event.IPHash+"|"+event.UserAgent] = struct{}{}
+	}
+
+	stats.Buckets = make([]bucketCount, 0, len(buckets))
+	for start, count := range buckets {
+		stats.Buckets = append(stats.Buckets, bucketCount{start, count})
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool {
+		return stats.Buckets[i].Start.Before(stats.Buckets[j].Start)
+	})
+	stats.TopReferrers = topValues(referrers)
+	stats.TopUserAgents = topValues(userAgents)
+	stats.UniqueVisitors = len(visitors)
+	return stats
+}
+
+func topValues(counts map[string]int) []rankedValue {
+	values := make([]rankedValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, rankedValue{value, count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if len(values) > topListSize {
+		values = values[:topListSize]
+	}
+	return values
+}
+
+func handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shortCode := r.URL.Query().Get("code")
+	if shortCode == "" {
+		http.Error(w, "Missing short code", http.StatusBadRequest)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	switch bucket {
+	case "":
+		bucket = "day"
+	case "hour", "day", "week":
+	default:
+		http.Error(w, "Invalid bucket, use hour, day or week", http.StatusBadRequest)
+		return
+	}
+
+	// archived links keep their click history, so their stats stay readable
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		if record, exists = store.LookupArchived(shortCode); !exists {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !readsLink(r, record) {
+		http.Error(w, "Forbidden: only the owner can see the stats of this link", http.StatusForbidden)
+		return
+	}
+
+	stats, err := store.ClickStats(shortCode, bucket)
+	if err != nil {
+		fmt.Printf("Error computing stats for %s: %v\n", shortCode, err)
+		http.Error(w, "Error loading click events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.1, 10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string // one entry per X-Forwarded-For header
+		want       string
+	}{
+		{"direct visitor", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer cannot forward", "203.0.113.7:5000", []string{"1.1.1.1"}, "203.0.113.7"},
+		{"trusted proxy", "127.0.0.1:5000", []string{"1.1.1.1"}, "1.1.1.1"},
+		{"spoofed hops left of the client are ignored", "127.0.0.1:5000", []string{"9.9.9.9, 1.1.1.1"}, "1.1.1.1"},
+		{"chain of trusted proxies", "127.0.0.1:5000", []string{"2.2.2.2, 10.1.2.3"}, "2.2.2.2"},
+		{"headers are joined in order", "127.0.0.1:5000", []string{"9.9.9.9", "3.3.3.3, 10.0.0.5"}, "3.3.3.3"},
+		{"garbage stops the walk", "127.0.0.1:5000", []string{"bogus, 10.0.0.5"}, "10.0.0.5"},
+		{"trusted proxy without header", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"only trusted hops", "127.0.0.1:5000", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		{"ipv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"ipv4 mapped proxy", "[::ffff:10.0.0.9]:5000", []string{"4.4.4.4"}, "4.4.4.4"},
+	}
+
+	saved := config.TrustedProxies
+	config.TrustedProxies = proxies
+	defer func() { config.TrustedProxies = saved }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/abc", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(r); got != test.want {
+				t.Errorf("clientIP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"127.0.0.1", "127.0.0.1/32", false},
+		{" 10.1.2.3/8 ,::1", "10.0.0.0/8,::1/128", false},
+		{"::ffff:192.168.0.1", "192.168.0.1/32", false},
+		{"1.2.3", "", true},
+		{"10.0.0.0/33", "", true},
+	}
+
+	for _, test := range tests {
+		proxies, err := parseTrustedProxies(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v", test.value, err)
+			continue
+		}
+		cfg := Config{TrustedProxies: proxies}
+		setting, _ := findSetting("trusted-proxies")
+		if got := setting.get(&cfg); got != test.want {
+			t.Errorf("parseTrustedProxies(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
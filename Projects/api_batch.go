@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchItemResult struct {
+	Index    int         `json:"index"`
+	Code     string      `json:"code,omitempty"`
+	ShortURL string      `json:"short_url,omitempty"`
+	Error    *batchError `json:"error,omitempty"`
+}
+
+// handleAPIBatch serves POST /api/v1/links/batch, any other method falls through
+// to the link named "batch"
+func handleAPIBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleAPILink(w, r)
+		return
+	}
+
+	var inputs []shortenRequest
+	if err := json.NewDecoder(r.Body).Decode(&inputs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "request body must be a JSON array of links")
+		return
+	}
+	if len(inputs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "batch is empty")
+		return
+	}
+	if len(inputs) > config.MaxBatchSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d links per batch", config.MaxBatchSize))
+		return
+	}
+
+	results := make([]batchItemResult, len(inputs))
+	var links []NewLink
+	var positions []int // index into inputs for every entry of links
+	for i, input := range inputs {
+		results[i].Index = i
+		link, err := input.newLink(r)
+		if err != nil {
+			results[i].Error = &batchError{"invalid", err.Error()}
+			continue
+		}
+		links = append(links, link)
+		positions = append(positions, i)
+	}
+
+	saved, err := store.SaveBatch(links)
+	if err != nil {
+		fmt.Printf("Error saving batch: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "error saving batch, no links were created")
+		return
+	}
+
+	created := 0
+	for j, result := range saved {
+		item := &results[positions[j]]
+		switch {
+		case errors.Is(result.Err, errCodeTaken):
+			item.Error = &batchError{"name_taken", "custom name already in use"}
+		case result.Err != nil:
+			item.Error = &batchError{"failed", result.Err.Error()}
+		default:
+			item.Code = result.ShortCode
+			item.ShortURL = shortURLFor(r, result.ShortCode)
+			created++
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Created int               `json:"created"`
+		Failed  int               `json:"failed"`
+		Results []batchItemResult `json:"results"`
+	}{created, len(inputs) - created, results})
+}
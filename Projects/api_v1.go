@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	maxCodeLength   = 64
+)
+
+type shortenRequest struct {
+	LongURL    string `json:"long_url"`
+	CustomName string `json:"custom_name,omitempty"`
+	ExpiresIn  string `json:"expires_in,omitempty"`
+	NotBefore  string `json:"not_before,omitempty"`
+	linkOptionsInput
+	clickLimitInput
+}
+
+// clickLimitInput is how a client limits the visits of a link, one_time is shorthand for max_clicks 1
+type clickLimitInput struct {
+	MaxClicks *int `json:"max_clicks"`
+	OneTime   bool `json:"one_time"`
+}
+
+// maxClicks returns the requested limit, nil when neither field was sent
+func (input clickLimitInput) maxClicks() (*int, error) {
+	if input.MaxClicks != nil && *input.MaxClicks < 0 {
+		return nil, errors.New("max_clicks may not be negative")
+	}
+	if !input.OneTime {
+		return input.MaxClicks, nil
+	}
+	if input.MaxClicks != nil && *input.MaxClicks != 1 {
+		return nil, errors.New("one_time links have max_clicks 1")
+	}
+	one := 1
+	return &one, nil
+}
+
+type linkResponse struct {
+	Code       string `json:"code"`
+	ShortURL   string `json:"short_url"`
+	LongURL    string `json:"long_url"`
+	CustomName string `json:"custom_name,omitempty"`
+	Clicks     int    `json:"clicks"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	NotBefore  string `json:"not_before,omitempty"`
+	ExpiresAt  string `json:"expires_at"`
+	UserID     int64  `json:"user_id,omitempty"`
+	Scheduled  bool   `json:"scheduled,omitempty"`
+	Expired    bool   `json:"expired"`
+
+	RedirectStatus int    `json:"redirect_status"`
+	ForwardQuery   string `json:"forward_query,omitempty"`
+	Prefix         bool   `json:"prefix,omitempty"`
+
+	PasswordProtected bool `json:"password_protected,omitempty"`
+	MaxClicks         int  `json:"max_clicks,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// baseURLFor is the configured public base URL, or the address r was sent to when none is set
+func baseURLFor(r *http.Request) string {
+	if config.BaseURL != "" {
+		return strings.TrimSuffix(config.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+func shortURLFor(r *http.Request, shortCode string) string {
+	return baseURLFor(r) + "/" + shortCode
+}
+
+func newLinkResponse(r *http.Request, link Link) linkResponse {
+	response := linkResponse{
+		Code:       link.ShortCode,
+		ShortURL:   shortURLFor(r, link.ShortCode),
+		LongURL:    link.LongURL,
+		CustomName: link.CustomName,
+		Clicks:     link.Clicks,
+		UserID:     link.UserID,
+		ExpiresAt:  link.ExpiresAt.UTC().Format(time.RFC3339),
+		Expired:    !time.Now().Before(link.ExpiresAt),
+
+		RedirectStatus: link.Options.redirectStatus(),
+		ForwardQuery:   link.Options.ForwardQuery,
+		Prefix:         link.Options.Prefix,
+
+		PasswordProtected: link.Options.PasswordHash != "",
+		MaxClicks:         link.MaxClicks,
+	}
+	if !link.CreatedAt.IsZero() {
+		response.CreatedAt = link.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if !link.NotBefore.IsZero() {
+		response.NotBefore = link.NotBefore.UTC().Format(time.RFC3339)
+		response.Scheduled = time.Now().Before(link.NotBefore) && !response.Expired
+	}
+	return response
+}
+
+func isValidShortCode(code string) bool {
+	if code == "" || len(code) > maxCodeLength {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+var errNotBeforeExpiry = errors.New("not_before must be before the link expires")
+
+// newLink validates the request and turns it into a link owned by the calling key's user
+func (input shortenRequest) newLink(r *http.Request) (NewLink, error) {
+	link := NewLink{
+		LongURL:    input.LongURL,
+		ExpiresIn:  config.DefaultExpiry,
+		CustomName: input.CustomName,
+		UserID:     keyFromContext(r).UserID,
+	}
+	if input.LongURL == "" {
+		return link, errors.New("URL is required")
+	}
+	if !isValidURL(input.LongURL) {
+		return link, errors.New("invalid URL format")
+	}
+	if input.CustomName != "" && !isValidShortCode(input.CustomName) {
+		return link, errors.New("custom name may only contain letters, digits, - and _")
+	}
+	if input.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(input.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			return link, errors.New("invalid expiration duration")
+		}
+		link.ExpiresIn = expiresIn
+	}
+	if input.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, input.NotBefore)
+		if err != nil {
+			return link, errors.New("not_before must be RFC3339")
+		}
+		if !notBefore.Before(time.Now().Add(link.ExpiresIn)) {
+			return link, errNotBeforeExpiry
+		}
+		link.NotBefore = notBefore
+	}
+	if err := input.apply(&link.Options); err != nil {
+		return link, err
+	}
+	maxClicks, err := input.maxClicks()
+	if err != nil {
+		return link, err
+	}
+	if maxClicks != nil {
+		link.MaxClicks = *maxClicks
+	}
+	return link, nil
+}
+
+// handleAPILinks serves /api/v1/links: GET lists, POST creates
+func handleAPILinks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listLinks(w, r)
+	case http.MethodPost:
+		createLink(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAPILink serves /api/v1/links/<code>: GET, PATCH and DELETE
+func handleAPILink(w http.ResponseWriter, r *http.Request) {
+	shortCode := strings.TrimPrefix(r.URL.Path, "/api/v1/links/")
+	if shortCode == "" {
+		handleAPILinks(w, r)
+		return
+	}
+	if code, ok := strings.CutSuffix(shortCode, "/renew"); ok {
+		renewLink(w, r, code)
+		return
+	}
+	if code, ok := strings.CutSuffix(shortCode, "/logo"); ok {
+		handleLinkLogo(w, r, code)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		record, exists := store.Lookup(shortCode)
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "link not found")
+			return
+		}
+		if !readsLink(r, record) {
+			writeJSONError(w, http.StatusForbidden, "only the owner can see this link")
+			return
+		}
+		writeJSON(w, http.StatusOK, newLinkResponse(r, Link{shortCode, record}))
+	case http.MethodPatch:
+		patchLink(w, r, shortCode)
+	case http.MethodDelete:
+		record, exists := store.Lookup(shortCode)
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "link not found")
+			return
+		}
+		if !ownsLink(r, record) {
+			writeJSONError(w, http.StatusForbidden, "only the owner can delete this link")
+			return
+		}
+		if err := store.Delete(shortCode); err != nil {
+			fmt.Printf("Error deleting %s: %v\n", shortCode, err)
+			writeJSONError(w, http.StatusInternalServerError, "error deleting link")
+			return
+		}
+		qrCodes.Invalidate(shortCode)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// ownsLink reports whether the calling key's user may change record; links made without a key
+// (the web form, /api/shorten before keys had users) belong to nobody, so no key can change them
+func ownsLink(r *http.Request, record URLRecord) bool {
+	return record.UserID != 0 && record.UserID == keyFromContext(r).UserID
+}
+
+// readsLink reports whether the calling key may see record and its stats: its own links, and
+// links without an owner unless a password keeps their destination private
+func readsLink(r *http.Request, record URLRecord) bool {
+	return ownsLink(r, record) || (record.UserID == 0 && record.Options.PasswordHash == "")
+}
+
+// listLinks lists the links of the calling key's user
+func listLinks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := LinkFilter{
+		Prefix: query.Get("prefix"),
+		UserID: keyFromContext(r).UserID,
+		Limit:  defaultPageSize,
+	}
+
+	switch state := query.Get("state"); state {
+	case "", "all":
+	case linkStateActive, linkStateExpired, linkStateScheduled, linkStateArchived:
+		filter.State = state
+	default:
+		writeJSONError(w, http.StatusBadRequest, "state must be active, scheduled, expired, archived or all")
+		return
+	}
+
+	var err error
+	if filter.Limit, err = intParam(query.Get("limit"), defaultPageSize); err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+		return
+	}
+	if filter.Offset, err = intParam(query.Get("offset"), 0); err != nil || filter.Offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative number")
+		return
+	}
+	if filter.CreatedAfter, err = timeParam(query.Get("created_after")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "created_after must be RFC3339 or YYYY-MM-DD")
+		return
+	}
+	if filter.CreatedBefore, err = timeParam(query.Get("created_before")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "created_before must be RFC3339 or YYYY-MM-DD")
+		return
+	}
+
+	links, total, err := store.List(filter)
+	if err != nil {
+		fmt.Printf("Error listing links: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "error listing links")
+		return
+	}
+
+	response := struct {
+		Links  []linkResponse `json:"links"`
+		Total  int            `json:"total"`
+		Limit  int            `json:"limit"`
+		Offset int            `json:"offset"`
+	}{
+		Links:  make([]linkResponse, 0, len(links)),
+		Total:  total,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	}
+	for _, link := range links {
+		response.Links = append(response.Links, newLinkResponse(r, link))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func createLink(w http.ResponseWriter, r *http.Request) {
+	var input shortenRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	link, err := input.newLink(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	shortCode, err := store.Save(link)
+	if errors.Is(err, errCodeTaken) {
+		writeJSONError(w, http.StatusConflict, "custom name already in use")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error saving URL: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "error saving link")
+		return
+	}
+
+	record, _ := store.Lookup(shortCode)
+	writeJSON(w, http.StatusCreated, newLinkResponse(r, Link{shortCode, record}))
+}
+
+func patchLink(w http.ResponseWriter, r *http.Request, shortCode string) {
+	var input struct {
+		LongURL    *string `json:"long_url"`
+		ExpiresIn  *string `json:"expires_in"`
+		ExpiresAt  *string `json:"expires_at"`
+		NotBefore  *string `json:"not_before"`
+		CustomName *string `json:"custom_name"`
+		linkOptionsInput
+		clickLimitInput
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	var update LinkUpdate
+	if input.LongURL != nil {
+		if !isValidURL(*input.LongURL) {
+			writeJSONError(w, http.StatusBadRequest, "invalid URL format")
+			return
+		}
+		update.LongURL = input.LongURL
+	}
+	if input.ExpiresIn != nil && input.ExpiresAt != nil {
+		writeJSONError(w, http.StatusBadRequest, "set either expires_in or expires_at, not both")
+		return
+	}
+	if input.ExpiresIn != nil {
+		expiresIn, err := time.ParseDuration(*input.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid expiration duration")
+			return
+		}
+		expiresAt := time.Now().Add(expiresIn)
+		update.ExpiresAt = &expiresAt
+	}
+	if input.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *input.ExpiresAt)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "expires_at must be RFC3339")
+			return
+		}
+		update.ExpiresAt = &expiresAt
+	}
+	if input.CustomName != nil {
+		if !isValidShortCode(*input.CustomName) {
+			writeJSONError(w, http.StatusBadRequest, "custom name may only contain letters, digits, - and _")
+			return
+		}
+		update.NewCode = input.CustomName
+	}
+	if input.NotBefore != nil {
+		var notBefore time.Time
+		if *input.NotBefore != "" {
+			var err error
+			if notBefore, err = time.Parse(time.RFC3339, *input.NotBefore); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "not_before must be RFC3339 or empty")
+				return
+			}
+		}
+		update.NotBefore = &notBefore
+	}
+	maxClicks, err := input.maxClicks()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	update.MaxClicks = maxClicks
+
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if !ownsLink(r, record) {
+		writeJSONError(w, http.StatusForbidden, "only the owner can change this link")
+		return
+	}
+	if update.NotBefore != nil || update.ExpiresAt != nil {
+		notBefore, expiresAt := record.NotBefore, record.ExpiresAt
+		if update.NotBefore != nil {
+			notBefore = *update.NotBefore
+		}
+		if update.ExpiresAt != nil {
+			expiresAt = *update.ExpiresAt
+		}
+		if !notBefore.Before(expiresAt) {
+			writeJSONError(w, http.StatusBadRequest, errNotBeforeExpiry.Error())
+			return
+		}
+	}
+	if input.changed() {
+		options := record.Options
+		if err := input.apply(&options); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		update.Options = &options
+	}
+
+	newCode, err := store.Update(shortCode, update)
+	switch {
+	case errors.Is(err, errLinkNotFound):
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	case errors.Is(err, errCodeTaken):
+		writeJSONError(w, http.StatusConflict, "custom name already in use")
+		return
+	case errors.Is(err, errClicksPassed):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		fmt.Printf("Error updating %s: %v\n", shortCode, err)
+		writeJSONError(w, http.StatusInternalServerError, "error updating link")
+		return
+	}
+	qrCodes.Invalidate(shortCode)
+
+	record, _ = store.Lookup(newCode)
+	writeJSON(w, http.StatusOK, newLinkResponse(r, Link{newCode, record}))
+}
+
+// renewLink pushes the expiry of a link owned by the caller, expired links can be renewed
+// until the sweep archives them
+func renewLink(w http.ResponseWriter, r *http.Request, shortCode string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if !ownsLink(r, record) {
+		writeJSONError(w, http.StatusForbidden, "only the owner can renew this link")
+		return
+	}
+
+	var input struct {
+		ExpiresIn string `json:"expires_in"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	expiresIn := config.DefaultExpiry
+	if input.ExpiresIn != "" {
+		var err error
+		expiresIn, err = time.ParseDuration(input.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid expiration duration")
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(expiresIn)
+	_, err := store.Update(shortCode, LinkUpdate{ExpiresAt: &expiresAt})
+	if errors.Is(err, errLinkNotFound) {
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error renewing %s: %v\n", shortCode, err)
+		writeJSONError(w, http.StatusInternalServerError, "error renewing link")
+		return
+	}
+	qrCodes.Invalidate(shortCode)
+
+	record, _ = store.Lookup(shortCode)
+	writeJSON(w, http.StatusOK, newLinkResponse(r, Link{shortCode, record}))
+}
+
+func intParam(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func timeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scopeCreate = "create"
+	scopeRead   = "read"
+	scopeUpdate = "update"
+	scopeDelete = "delete"
+	scopeStats  = "stats"
+	scopeKeys   = "keys" // list, create and revoke the user's other keys
+
+	apiKeyPrefix = "usk_"
+	// last_used_at is only written when it is older than this, not on every request
+	keyTouchInterval = time.Minute
+)
+
+var allScopes = []string{scopeCreate, scopeRead, scopeUpdate, scopeDelete, scopeStats, scopeKeys}
+
+var (
+	errKeyNotFound = errors.New("API key not found")
+	errKeyExpired  = errors.New("API key expired")
+)
+
+// APIKey is an issued key, the plaintext is only known when it is created
+type APIKey struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+	RateLimit  rateLimit // zero uses the API default
+}
+
+func (key APIKey) HasScope(scope string) bool {
+	return slices.Contains(key.Scopes, scope)
+}
+
+type apiKeyContextKey struct{}
+
+// keyFromContext returns the key that authenticated r, or the zero key for anonymous requests
+func keyFromContext(r *http.Request) APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	return key
+}
+
+func hashAPIKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseScopes(list string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(allScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// ensureUser returns the id of username, creating a user without a usable password if needed
+func ensureUser(username string) (int64, error) {
+	_, err := db.Exec("INSERT OR IGNORE INTO users (username, password) VALUES (?, '!')", username)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	return id, err
+}
+
+func userID(username string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("unknown user %q", username)
+	}
+	return id, err
+}
+
+// createAPIKey stores a new key and returns it together with its plaintext
+func createAPIKey(userID int64, name string, scopes []string, expiresIn time.Duration) (APIKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	plain := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plain[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	var expiresAt sql.NullTime
+	if expiresIn > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(expiresIn)
+		expiresAt = sql.NullTime{Time: key.ExpiresAt, Valid: true}
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO api_keys (user_id, name, key_hash, prefix, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		key.UserID, key.Name, hashAPIKey(plain), key.Prefix, strings.Join(key.Scopes, ","), key.CreatedAt, expiresAt,
+	)
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("failed to insert API key: %v", err)
+	}
+	key.ID, err = result.LastInsertId()
+	return key, plain, err
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at, rate_limit"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	var limit sql.NullString
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt, &limit)
+	if err != nil {
+		return key, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.ExpiresAt = expiresAt.Time
+	key.LastUsedAt = lastUsedAt.Time
+	key.RevokedAt = revokedAt.Time
+	if limit.Valid {
+		key.RateLimit, err = parseRateLimit(limit.String)
+	}
+	return key, err
+}
+
+// findAPIKey returns the live key matching plain and records that it was used
+func findAPIKey(plain string) (APIKey, error) {
+	key, err := scanAPIKey(db.QueryRow(
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL",
+		hashAPIKey(plain),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, errKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	now := time.Now()
+	if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+		return APIKey{}, errKeyExpired
+	}
+	if now.Sub(key.LastUsedAt) > keyTouchInterval {
+		if _, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now.UTC(), key.ID); err != nil {
+			fmt.Printf("Error updating last use of API key %d: %v\n", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+func listAPIKeys(userID int64) ([]APIKey, error) {
+	rows, err := db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// setAPIKeyRateLimit overrides the API rate limit for one key, a zero limit goes back to the default
+func setAPIKeyRateLimit(userID, id int64, limit rateLimit) error {
+	value := sql.NullString{String: limit.String(), Valid: limit.Burst > 0}
+	result, err := db.Exec("UPDATE api_keys SET rate_limit = ? WHERE id = ? AND user_id = ?", value, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+func getAPIKey(userID, id int64) (APIKey, error) {
+	key, err := scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ? AND user_id = ?", id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, errKeyNotFound
+	}
+	return key, err
+}
+
+func revokeAPIKey(userID, id int64) error {
+	result, err := db.Exec(
+		"UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+// scope and linkScopes say which scope a request needs
+func scope(name string) func(r *http.Request) string {
+	return func(r *http.Request) string { return name }
+}
+
+func linkScopes(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "/renew") {
+		return scopeUpdate
+	}
+	if strings.HasSuffix(r.URL.Path, "/logo") && r.Method != http.MethodGet {
+		return scopeUpdate
+	}
+	switch r.Method {
+	case http.MethodPost:
+		return scopeCreate
+	case http.MethodPatch:
+		return scopeUpdate
+	case http.MethodDelete:
+		return scopeDelete
+	default:
+		return scopeRead
+	}
+}
+
+// apiError answers in JSON on the v1 API and in plain text on the older endpoints
+func apiError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		writeJSONError(w, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func apiKeyMiddleware(required func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		plain := r.Header.Get("X-API-Key")
+		if plain == "" {
+			apiError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		key, err := findAPIKey(plain)
+		if err != nil {
+			if !errors.Is(err, errKeyNotFound) && !errors.Is(err, errKeyExpired) {
+				fmt.Printf("Error looking up API key: %v\n", err)
+			}
+			apiError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if scope := required(r); scope != "" && !key.HasScope(scope) {
+			apiError(w, r, http.StatusForbidden, fmt.Sprintf("API key lacks the %q scope", scope))
+			return
+		}
+		if !checkRateLimit(w, r, apiLimiter, strconv.FormatInt(key.ID, 10), key.RateLimit) {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+type apiKeyResponse struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+	RateLimit  string   `json:"rate_limit,omitempty"`
+	Key        string   `json:"key,omitempty"`
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func newAPIKeyResponse(key APIKey) apiKeyResponse {
+	response := apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  formatOptionalTime(key.CreatedAt),
+		ExpiresAt:  formatOptionalTime(key.ExpiresAt),
+		LastUsedAt: formatOptionalTime(key.LastUsedAt),
+		RevokedAt:  formatOptionalTime(key.RevokedAt),
+	}
+	if key.RateLimit.Burst > 0 {
+		response.RateLimit = key.RateLimit.String()
+	}
+	return response
+}
+
+// handleAPIKeys serves /api/v1/keys (GET list, POST create) and DELETE /api/v1/keys/<id>,
+// always for the user owning the calling key
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	caller := keyFromContext(r)
+	idPart := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/keys"), "/")
+
+	switch {
+	case idPart == "" && r.Method == http.MethodGet:
+		keys, err := listAPIKeys(caller.UserID)
+		if err != nil {
+			fmt.Printf("Error listing API keys: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error listing keys")
+			return
+		}
+		response := make([]apiKeyResponse, 0, len(keys))
+		for _, key := range keys {
+			response = append(response, newAPIKeyResponse(key))
+		}
+		writeJSON(w, http.StatusOK, map[string][]apiKeyResponse{"keys": response})
+
+	case idPart == "" && r.Method == http.MethodPost:
+		var input struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn string   `json:"expires_in"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		scopes, err := parseScopes(strings.Join(input.Scopes, ","))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// a key can only hand out scopes it has itself
+		for _, scope := range scopes {
+			if !caller.HasScope(scope) {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("cannot grant the %q scope", scope))
+				return
+			}
+		}
+		var expiresIn time.Duration
+		if input.ExpiresIn != "" {
+			expiresIn, err = time.ParseDuration(input.ExpiresIn)
+			if err != nil || expiresIn <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid expiration duration")
+				return
+			}
+		}
+		// nor outlive itself
+		if !caller.ExpiresAt.IsZero() {
+			if expiresIn == 0 {
+				writeJSONError(w, http.StatusForbidden, "a key that expires cannot create one that never does")
+				return
+			}
+			expiresIn = min(expiresIn, time.Until(caller.ExpiresAt))
+		}
+
+		key, plain, err := createAPIKey(caller.UserID, input.Name, scopes, expiresIn)
+		if err != nil {
+			fmt.Printf("Error creating API key: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error creating key")
+			return
+		}
+		response := newAPIKeyResponse(key)
+		response.Key = plain
+		writeJSON(w, http.StatusCreated, response)
+
+	case idPart != "" && r.Method == http.MethodDelete:
+		id, err := strconv.ParseInt(idPart, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid key id")
+			return
+		}
+		target, err := getAPIKey(caller.UserID, id)
+		if err == nil {
+			// revoking is limited the same way as creating, to keys with no scope the caller lacks
+			for _, scope := range target.Scopes {
+				if !caller.HasScope(scope) {
+					writeJSONError(w, http.StatusForbidden, fmt.Sprintf("cannot revoke a key with the %q scope", scope))
+					return
+				}
+			}
+			err = revokeAPIKey(caller.UserID, id)
+		}
+		if errors.Is(err, errKeyNotFound) {
+			writeJSONError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error revoking API key %d: %v\n", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "error revoking key")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// runAPIKeyCommand handles "apikey create|list|revoke" so the first key can be issued from the shell
+func runAPIKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: apikey create|list|revoke|limit -user <name> [flags]")
+	}
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	username := flags.String("user", "", "User owning the key")
+	name := flags.String("name", "", "(create) Label for the key")
+	scopeList := flags.String("scopes", strings.Join(allScopes, ","), "(create) Comma separated scopes")
+	expires := flags.Duration("expires", 0, "(create) Lifetime of the key, 0 never expires")
+	id := flags.Int64("id", 0, "(revoke, limit) Id of the key")
+	rate := flags.String("rate", "", "(create, limit) Rate limit for the key like 600/m, empty or 0 uses the default")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("-user is required")
+	}
+
+	switch args[0] {
+	case "create":
+		scopes, err := parseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		uid, err := ensureUser(*username)
+		if err != nil {
+			return err
+		}
+		limit, err := parseRateLimit(*rate)
+		if err != nil {
+			return err
+		}
+		key, plain, err := createAPIKey(uid, *name, scopes, *expires)
+		if err != nil {
+			return err
+		}
+		if limit.Burst > 0 {
+			if err := setAPIKeyRateLimit(uid, key.ID, limit); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Created key %d for %s with scopes %s\n", key.ID, *username, strings.Join(key.Scopes, ","))
+		fmt.Printf("Key: %s (it is not shown again)\n", plain)
+	case "list":
+		uid, err := userID(*username)
+		if err != nil {
+			return err
+		}
+		keys, err := listAPIKeys(uid)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			state := "active"
+			if !key.RevokedAt.IsZero() {
+				state = "revoked"
+			} else if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+				state = "expired"
+			}
+			limit := "default"
+			if key.RateLimit.Burst > 0 {
+				limit = key.RateLimit.String()
+			}
+			fmt.Printf("%4d  %-12s %-10s %-8s %-10s %s\n", key.ID, key.Prefix, key.Name, state, limit, strings.Join(key.Scopes, ","))
+		}
+	case "revoke":
+		uid, err := userID(*username)
+		if err != nil {
+			return err
+		}
+		if err := revokeAPIKey(uid, *id); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %d\n", *id)
+	case "limit":
+		uid, err := userID(*username)
+		if err != nil {
+			return err
+		}
+		limit, err := parseRateLimit(*rate)
+		if err != nil {
+			return err
+		}
+		if err := setAPIKeyRateLimit(uid, *id, limit); err != nil {
+			return err
+		}
+		fmt.Printf("Rate limit of key %d is now %s\n", *id, limit)
+	default:
+		return fmt.Errorf("unknown apikey command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+var clickLog *clickRecorder
+
+const clickQueueSize = 1024
+
+// clickRecorder writes click events in the background so redirects don't wait on analytics
+type clickRecorder struct {
+	events chan ClickEvent
+	done   chan struct{}
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newClickRecorder() *clickRecorder {
+	recorder := &clickRecorder{
+		events: make(chan ClickEvent, clickQueueSize),
+		done:   make(chan struct{}),
+	}
+	go recorder.run()
+	return recorder
+}
+
+func (recorder *clickRecorder) run() {
+	defer close(recorder.done)
+	for event := range recorder.events {
+		recorder.write(event)
+	}
+}
+
+func (recorder *clickRecorder) write(event ClickEvent) {
+	if err := store.RecordClick(event); err != nil {
+		fmt.Printf("Error recording click for %s: %v\n", event.ShortCode, err)
+	}
+}
+
+// Record queues event, or writes it right away when the queue is full or already closed so nothing
+// is dropped; handlers that outlive the shutdown deadline still record their clicks after Close
+func (recorder *clickRecorder) Record(event ClickEvent) {
+	recorder.mutex.RLock()
+	defer recorder.mutex.RUnlock()
+	if recorder.closed {
+		recorder.write(event)
+		return
+	}
+	select {
+	case recorder.events <- event:
+	default:
+		recorder.write(event)
+	}
+}
+
+// Close flushes every queued event, later events are written directly
+func (recorder *clickRecorder) Close() {
+	recorder.mutex.Lock()
+	if !recorder.closed {
+		recorder.closed = true
+		close(recorder.events)
+	}
+	recorder.mutex.Unlock()
+	<-recorder.done
+}
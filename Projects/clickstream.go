@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var clickStreams = newClickHub()
+
+const streamHeartbeat = 15 * time.Second
+
+// clickHub fans click counts out to every live /clicks/<code>/stream subscriber
+type clickHub struct {
+	subscribers map[string]map[chan int]struct{}
+	mutex       sync.Mutex
+}
+
+func newClickHub() *clickHub {
+	return &clickHub{
+		subscribers: make(map[string]map[chan int]struct{}),
+	}
+}
+
+// Subscribe returns a channel of new counts for shortCode and a func that must be called to stop listening
+func (hub *clickHub) Subscribe(shortCode string) (<-chan int, func()) {
+	// buffer of one so a slow reader only ever gets the latest count
+	ch := make(chan int, 1)
+
+	hub.mutex.Lock()
+	if hub.subscribers[shortCode] == nil {
+		hub.subscribers[shortCode] = make(map[chan int]struct{})
+	}
+	hub.subscribers[shortCode][ch] = struct{}{}
+	hub.mutex.Unlock()
+
+	return ch, func() {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		delete(hub.subscribers[shortCode], ch)
+		if len(hub.subscribers[shortCode]) == 0 {
+			delete(hub.subscribers, shortCode)
+		}
+	}
+}
+
+func (hub *clickHub) Publish(shortCode string, count int) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for ch := range hub.subscribers[shortCode] {
+		select {
+		case <-ch: // drop the stale count nobody read yet
+		default:
+		}
+		ch <- count
+	}
+}
+
+func handleClickStream(w http.ResponseWriter, r *http.Request, shortCode string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the stream lives far longer than the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		fmt.Printf("Error clearing write deadline for stream: %v\n", err)
+	}
+
+	updates, unsubscribe := clickStreams.Subscribe(shortCode)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(count int) error {
+		data, err := json.Marshal(map[string]int{"clicks": count})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := send(record.Clicks); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case count := <-updates:
+			if err := send(count); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// comment line, keeps proxies from closing the idle connection and notices dead clients
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
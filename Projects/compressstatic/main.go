@@ -0,0 +1,52 @@
+// compressstatic writes a brotli compressed <name>.br next to every file in a directory. The server
+// embeds them as they are, since brotli is too slow to run at startup; rerun it with go generate
+// in Projects whenever a file in Projects/static changes.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("usage: compressstatic <dir>")
+		os.Exit(2)
+	}
+	err := filepath.WalkDir(os.Args[1], func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".br") {
+			return err
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		writer := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		if _, err := writer.Write(raw); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		// like the gzip variants, a file that doesn't shrink is only served as it is
+		if buf.Len() >= len(raw) {
+			if err := os.Remove(path + ".br"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		fmt.Printf("%s: %d -> %d bytes\n", path, len(raw), buf.Len())
+		return os.WriteFile(path+".br", buf.Bytes(), 0644)
+	})
+	if err != nil {
+		fmt.Printf("Error compressing static files: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var config = defaultConfig()
+
+// Config holds every runtime setting. Values are taken from, highest first:
+// command line flags, URLSHORTENER_* environment variables, the JSON config file, the defaults below.
+type Config struct {
+	Listen          string
+	BaseURL         string // public address used in short links, empty derives it from each request
+	DefaultExpiry   time.Duration
+	CodeLength      int
+	CleanupInterval time.Duration
+	ExpiryGrace     time.Duration // how long expired links wait for a renewal before being archived
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	Store           string
+	DBPath          string
+	LogPath         string
+	RateWeb         string
+	RateAPI         string
+	RateRedirect    string
+	RateUnlock      string
+	UnlockTTL       time.Duration
+	MaxBatchSize    int
+	QRCacheSize     int
+	IPHashSalt      string
+	TrustedProxies  []netip.Prefix // proxies whose X-Forwarded-For names the client, see clientIP
+	CSRFSecret      string
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":8080",
+		DefaultExpiry:   24 * time.Hour,
+		CodeLength:      6,
+		CleanupInterval: 5 * time.Minute, //prolly want every hour but for testing do every 5 mins
+		ExpiryGrace:     72 * time.Hour,
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 15 * time.Second,
+		Store:           "sqlite",
+		DBPath:          "./urlshortener.sqlite",
+		LogPath:         "./urlshortener.log",
+		RateWeb:         "20/m",
+		RateAPI:         "120/m",
+		RateRedirect:    "600/m",
+		RateUnlock:      "5/m",
+		UnlockTTL:       30 * time.Minute,
+		MaxBatchSize:    5000,
+		QRCacheSize:     512,
+	}
+}
+
+// setting ties one Config field to its flag, environment variable and config file key
+type setting struct {
+	name   string // flag name and config file key
+	usage  string
+	secret bool
+	set    func(cfg *Config, value string) error
+	get    func(cfg *Config) string
+}
+
+func (s setting) env() string {
+	return "URLSHORTENER_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func stringSetting(name, usage string, field func(cfg *Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			*field(cfg) = value
+			return nil
+		},
+		get: func(cfg *Config) string { return *field(cfg) },
+	}
+}
+
+func durationSetting(name, usage string, field func(cfg *Config) *time.Duration) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			*field(cfg) = d
+			return nil
+		},
+		get: func(cfg *Config) string { return field(cfg).String() },
+	}
+}
+
+func intSetting(name, usage string, field func(cfg *Config) *int) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			*field(cfg) = n
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.Itoa(*field(cfg)) },
+	}
+}
+
+func rateSetting(name, usage string, field func(cfg *Config) *string) setting {
+	s := stringSetting(name, usage, field)
+	s.set = func(cfg *Config, value string) error {
+		if _, err := parseRateLimit(value); err != nil {
+			return err
+		}
+		*field(cfg) = value
+		return nil
+	}
+	return s
+}
+
+var settings = []setting{
+	stringSetting("listen", "Address the server listens on", func(c *Config) *string { return &c.Listen }),
+	stringSetting("base-url", "Public base URL like https://sho.rt, empty uses the request host", func(c *Config) *string { return &c.BaseURL }),
+	durationSetting("default-expiry", "Lifetime of links created without expires_in", func(c *Config) *time.Duration { return &c.DefaultExpiry }),
+	intSetting("code-length", "Length of generated short codes", func(c *Config) *int { return &c.CodeLength }),
+	durationSetting("cleanup-interval", "How often expired links are swept", func(c *Config) *time.Duration { return &c.CleanupInterval }),
+	{
+		name:  "expiry-grace",
+		usage: "How long expired links can still be renewed before they are archived, 0 archives right away",
+		set: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			c.ExpiryGrace = d
+			return nil
+		},
+		get: func(c *Config) string { return c.ExpiryGrace.String() },
+	},
+	durationSetting("read-timeout", "Longest time to read a request", func(c *Config) *time.Duration { return &c.ReadTimeout }),
+	durationSetting("write-timeout", "Longest time to write a response, click streams are exempt", func(c *Config) *time.Duration { return &c.WriteTimeout }),
+	durationSetting("idle-timeout", "How long idle keep-alive connections stay open", func(c *Config) *time.Duration { return &c.IdleTimeout }),
+	durationSetting("shutdown-timeout", "How long a shutdown waits for in-flight requests", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringSetting("store", "Storage backend: memory, sqlite, file", func(c *Config) *string { return &c.Store }),
+	stringSetting("db", "Path of the SQLite database", func(c *Config) *string { return &c.DBPath }),
+	stringSetting("log", "Path of the append-only log used by the file backend", func(c *Config) *string { return &c.LogPath }),
+	rateSetting("rate-web", "Rate limit per client IP for the /shorten form, 0 disables", func(c *Config) *string { return &c.RateWeb }),
+	rateSetting("rate-api", "Default rate limit per API key, 0 disables", func(c *Config) *string { return &c.RateAPI }),
+	rateSetting("rate-redirect", "Rate limit per client IP for redirects, 0 disables", func(c *Config) *string { return &c.RateRedirect }),
+	rateSetting("rate-unlock", "Password attempts allowed per protected link, 0 disables", func(c *Config) *string { return &c.RateUnlock }),
+	durationSetting("unlock-ttl", "How long a correct password unlocks a link in that browser", func(c *Config) *time.Duration { return &c.UnlockTTL }),
+	intSetting("max-batch-size", "Most links accepted by one /api/v1/links/batch call", func(c *Config) *int { return &c.MaxBatchSize }),
+	intSetting("qr-cache-size", "Most rendered QR codes kept in memory", func(c *Config) *int { return &c.QRCacheSize }),
+	{
+		name:  "trusted-proxies",
+		usage: "Comma-separated proxy IPs or CIDRs allowed to set X-Forwarded-For, empty uses the connecting address",
+		set: func(c *Config, value string) error {
+			proxies, err := parseTrustedProxies(value)
+			if err != nil {
+				return err
+			}
+			c.TrustedProxies = proxies
+			return nil
+		},
+		get: func(c *Config) string {
+			proxies := make([]string, len(c.TrustedProxies))
+			for i, proxy := range c.TrustedProxies {
+				proxies[i] = proxy.String()
+			}
+			return strings.Join(proxies, ",")
+		},
+	},
+	{
+		name:   "ip-salt",
+		usage:  "Salt mixed into hashed visitor IPs, empty uses a random one kept in the database",
+		secret: true,
+		set: func(c *Config, value string) error {
+			c.IPHashSalt = value
+			return nil
+		},
+		get: func(c *Config) string { return c.IPHashSalt },
+	},
+	{
+		name:   "csrf-secret",
+		usage:  "Key that signs form CSRF tokens and unlock cookies, random per run when empty",
+		secret: true,
+		set: func(c *Config, value string) error {
+			c.CSRFSecret = value
+			return nil
+		},
+		get: func(c *Config) string { return c.CSRFSecret },
+	},
+}
+
+// loadConfig parses the command line and builds the effective config, leaving
+// positional arguments (migrate, apikey) in flag.Args
+func loadConfig() (Config, error) {
+	configPath := flag.String("config", os.Getenv("URLSHORTENER_CONFIG"), "Path of a JSON config file")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.name] = flag.String(s.name, "", fmt.Sprintf("%s (env %s)", s.usage, s.env()))
+	}
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := applyConfigFile(&cfg, *configPath); err != nil {
+			return cfg, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("%s: %v", s.env(), err)
+			}
+		}
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		s, ok := findSetting(f.Name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := s.set(&cfg, *flagValues[f.Name]); setErr != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, setErr)
+		}
+	})
+	return cfg, err
+}
+
+func findSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// applyConfigFile reads a flat JSON object keyed by setting name, e.g. {"listen": ":80", "code-length": 8}
+func applyConfigFile(cfg *Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	var values map[string]any
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	for name, value := range values {
+		s, ok := findSetting(name)
+		if !ok {
+			return fmt.Errorf("unknown setting %q in config file", name)
+		}
+		if err := s.set(cfg, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s in config file: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func printConfig(cfg Config) {
+	fmt.Println("Effective configuration:")
+	for _, s := range settings {
+		value := s.get(&cfg)
+		if s.secret && value != "" {
+			value = "(set)"
+		}
+		if value == "" {
+			value = "(empty)"
+		}
+		fmt.Printf("  %-17s %s\n", s.name, value)
+	}
+}
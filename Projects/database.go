@@ -1,48 +1,64 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	_ "modernc.org/sqlite"
 )
 
 var db *sql.DB
 
-func initDB() error {
-	fmt.Println("Initializing database...")
+// openDB opens the database and makes sure schema_migrations exists, without migrating
+func openDB() error {
 	var err error
-	db, err = sql.Open("sqlite", "./urlshortener.sqlite")
+	// writers from the handlers and the background jobs wait for each other instead of failing with SQLITE_BUSY,
+	// immediate transactions take the write lock up front so they never have to upgrade a read lock
+	db, err = sql.Open("sqlite", config.DBPath+"?_pragma=busy_timeout(5000)&_txlock=immediate")
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
+	return ensureMigrationsTable(db)
+}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS users (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            username TEXT UNIQUE NOT NULL,
-            password TEXT NOT NULL
-        )
-    `)
-	if err != nil {
-		return fmt.Errorf("failed to create users table: %v", err)
-	}
-
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS urls (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER,
-            short_code TEXT UNIQUE NOT NULL,
-            long_url TEXT NOT NULL,
-            custom_name TEXT,
-            expires_at DATETIME,
-            clicks INTEGER DEFAULT 0,
-            FOREIGN KEY (user_id) REFERENCES users(id)
-        )
-    `)
+func initDB() error {
+	fmt.Println("Initializing database...")
+	if err := openDB(); err != nil {
+		return err
+	}
+
+	version, err := currentSchemaVersion(db)
 	if err != nil {
-		return fmt.Errorf("failed to create urls table: %v", err)
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d), refusing to start",
+			version, latestSchemaVersion())
+	}
+
+	if err := migrateUp(db, latestSchemaVersion()); err != nil {
+		return err
 	}
 
 	fmt.Println("Database initialization complete")
 	return nil
 }
+
+// storedSecret returns the random secret kept under name, generating it the first time so it
+// survives restarts; instances starting together all end up with whichever insert won
+func storedSecret(name string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	_, err := db.Exec("INSERT OR IGNORE INTO secrets (name, value) VALUES (?, ?)", name, hex.EncodeToString(buf))
+	if err != nil {
+		return "", fmt.Errorf("failed to store %s: %v", name, err)
+	}
+	var value string
+	if err := db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&value); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LinkOptions is how a link behaves when visited, kept as one JSON document per link
+type LinkOptions struct {
+	RedirectStatus int    `json:"redirect_status,omitempty"` // 301, 302, 307 or 308, 0 means 302
+	ForwardQuery   string `json:"forward_query,omitempty"`   // "" drops the visitor's query, otherwise a forward policy
+	Prefix         bool   `json:"prefix,omitempty"`          // /<code>/more/path appends more/path to the destination
+	PasswordHash   string `json:"password_hash,omitempty"`   // bcrypt hash, visitors must unlock the link first
+
+	// what visitors get before NotBefore and after expiry: a redirect to the URL if set,
+	// otherwise a page showing the message or a default one
+	PendingURL     string `json:"pending_url,omitempty"`
+	PendingMessage string `json:"pending_message,omitempty"`
+	ExpiredURL     string `json:"expired_url,omitempty"`
+	ExpiredMessage string `json:"expired_message,omitempty"`
+}
+
+const maxLinkMessage = 500
+
+// Query forwarding policies, they only differ for keys the destination already has
+const (
+	forwardKeep     = "keep"     // the destination's value wins
+	forwardOverride = "override" // the visitor's value wins
+	forwardAppend   = "append"   // both are sent, destination first
+)
+
+// linkOptionsInput is the JSON a client sends to set options, shared by create and PATCH
+type linkOptionsInput struct {
+	RedirectStatus *int    `json:"redirect_status"`
+	ForwardQuery   *string `json:"forward_query"`
+	Prefix         *bool   `json:"prefix"`
+	Password       *string `json:"password"` // "" removes the password
+	PendingURL     *string `json:"pending_url"`
+	PendingMessage *string `json:"pending_message"`
+	ExpiredURL     *string `json:"expired_url"`
+	ExpiredMessage *string `json:"expired_message"`
+}
+
+// apply validates input and copies every field that was sent onto options
+func (input linkOptionsInput) apply(options *LinkOptions) error {
+	if input.RedirectStatus != nil {
+		switch *input.RedirectStatus {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			options.RedirectStatus = *input.RedirectStatus
+		default:
+			return fmt.Errorf("redirect_status must be 301, 302, 307 or 308")
+		}
+	}
+	if input.ForwardQuery != nil {
+		switch *input.ForwardQuery {
+		case "", "off":
+			options.ForwardQuery = ""
+		case forwardKeep, forwardOverride, forwardAppend:
+			options.ForwardQuery = *input.ForwardQuery
+		default:
+			return fmt.Errorf("forward_query must be off, keep, override or append")
+		}
+	}
+	if input.Prefix != nil {
+		options.Prefix = *input.Prefix
+	}
+	if input.Password != nil {
+		hash, err := hashLinkPassword(*input.Password)
+		if err != nil {
+			return err
+		}
+		options.PasswordHash = hash
+	}
+	if input.PendingURL != nil {
+		if err := checkFallbackURL("pending_url", *input.PendingURL); err != nil {
+			return err
+		}
+		options.PendingURL = *input.PendingURL
+	}
+	if input.ExpiredURL != nil {
+		if err := checkFallbackURL("expired_url", *input.ExpiredURL); err != nil {
+			return err
+		}
+		options.ExpiredURL = *input.ExpiredURL
+	}
+	if input.PendingMessage != nil {
+		if err := checkLinkMessage("pending_message", *input.PendingMessage); err != nil {
+			return err
+		}
+		options.PendingMessage = *input.PendingMessage
+	}
+	if input.ExpiredMessage != nil {
+		if err := checkLinkMessage("expired_message", *input.ExpiredMessage); err != nil {
+			return err
+		}
+		options.ExpiredMessage = *input.ExpiredMessage
+	}
+	return nil
+}
+
+// checkFallbackURL accepts an empty value, which removes the fallback, or a URL like the link's own
+func checkFallbackURL(name, value string) error {
+	if value != "" && !isValidURL(value) {
+		return fmt.Errorf("%s is not a valid URL", name)
+	}
+	return nil
+}
+
+func checkLinkMessage(name, value string) error {
+	if len(value) > maxLinkMessage {
+		return fmt.Errorf("%s may be at most %d bytes", name, maxLinkMessage)
+	}
+	return nil
+}
+
+// changed reports whether any option was sent
+func (input linkOptionsInput) changed() bool {
+	return input.RedirectStatus != nil || input.ForwardQuery != nil || input.Prefix != nil || input.Password != nil ||
+		input.PendingURL != nil || input.PendingMessage != nil || input.ExpiredURL != nil || input.ExpiredMessage != nil
+}
+
+func (options LinkOptions) redirectStatus() int {
+	if options.RedirectStatus == 0 {
+		return http.StatusFound
+	}
+	return options.RedirectStatus
+}
+
+// destination is where a visit goes: the long URL plus, for prefix links, the escaped path after the code
+// and the visitor's query string if the link forwards it
+func (options LinkOptions) destination(longURL, rest string, r *http.Request) (string, error) {
+	target := longURL
+	if rest != "" {
+		var err error
+		if target, err = appendPath(target, rest); err != nil {
+			return "", err
+		}
+	}
+	if options.ForwardQuery == "" || r.URL.RawQuery == "" {
+		return target, nil
+	}
+	merged, err := forwardQuery(target, r.URL.RawQuery, options.ForwardQuery)
+	if err != nil {
+		fmt.Printf("Error forwarding query to %s: %v\n", target, err)
+		return target, nil
+	}
+	return merged, nil
+}
+
+var errUnsafePath = errors.New("path may not contain . or .. segments")
+
+// appendPath adds the escaped path rest below the destination's path, re-escaping every segment so
+// nothing in rest can add a query, a fragment or climb out of the destination with ..
+func appendPath(destination, rest string) (string, error) {
+	target, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	var segments []string
+	for _, raw := range strings.Split(rest, "/") {
+		if raw == "" {
+			continue
+		}
+		segment, err := url.PathUnescape(raw)
+		if err != nil {
+			return "", err
+		}
+		if segment == "." || segment == ".." {
+			return "", errUnsafePath
+		}
+		segments = append(segments, url.PathEscape(segment))
+	}
+	if len(segments) == 0 {
+		return destination, nil
+	}
+
+	joined := strings.TrimSuffix(target.EscapedPath(), "/") + "/" + strings.Join(segments, "/")
+	if strings.HasSuffix(rest, "/") {
+		joined += "/"
+	}
+	if target.Path, err = url.PathUnescape(joined); err != nil {
+		return "", err
+	}
+	target.RawPath = joined
+	return target.String(), nil
+}
+
+// forwardQuery merges the visitor's query into destination by policy, keeping the destination's own
+// parameters in their original order and encoding
+func forwardQuery(destination, visitorQuery, policy string) (string, error) {
+	target, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	existing := target.Query()
+
+	var added []string
+	sent := make(map[string]bool)
+	for _, pair := range strings.Split(visitorQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+		if _, conflict := existing[key]; conflict && policy == forwardKeep {
+			continue
+		}
+		sent[key] = true
+		added = append(added, url.QueryEscape(key)+"="+url.QueryEscape(value))
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(target.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(pair, "=")
+		if key, err := url.QueryUnescape(rawKey); err == nil && policy == forwardOverride && sent[key] {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+
+	target.RawQuery = strings.Join(append(kept, added...), "&")
+	return target.String(), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAppendPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		rest        string // escaped, as it comes from the request path
+		want        string
+		wantErr     error
+	}{
+		{"nested path", "https://example.com/base", "docs/intro", "https://example.com/base/docs/intro", nil},
+		{"destination ending in a slash", "https://example.com/base/", "a", "https://example.com/base/a", nil},
+		{"trailing slash kept", "https://example.com/base", "a//b/", "https://example.com/base/a/b/", nil},
+		{"destination query kept", "https://example.com/base?x=1", "a", "https://example.com/base/a?x=1", nil},
+		{"nothing to add", "https://example.com/base", "/", "https://example.com/base", nil},
+		{"escaped slash stays in its segment", "https://example.com/base", "a%2Fb", "https://example.com/base/a%2Fb", nil},
+		{"no query injection", "https://example.com/base", "a%3Fadmin=1", "https://example.com/base/a%3Fadmin=1", nil},
+		{"no fragment injection", "https://example.com/base", "%23top", "https://example.com/base/%23top", nil},
+		{"spaces escaped", "https://example.com/base", "a%20b", "https://example.com/base/a%20b", nil},
+		{"dot dot", "https://example.com/base", "..", "", errUnsafePath},
+		{"dot dot in the middle", "https://example.com/base", "a/../b", "", errUnsafePath},
+		{"escaped dot dot", "https://example.com/base", "%2e%2e/secret", "", errUnsafePath},
+		{"single dot", "https://example.com/base", "./a", "", errUnsafePath},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := appendPath(test.destination, test.rest)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("appendPath(%q, %q) error = %v, want %v", test.destination, test.rest, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("appendPath(%q, %q) = %q, want %q", test.destination, test.rest, got, test.want)
+			}
+		})
+	}
+
+	if _, err := appendPath("https://example.com/base", "%zz"); err == nil {
+		t.Error("appendPath accepted a broken escape")
+	}
+}
+
+func TestForwardQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		destination  string
+		visitorQuery string
+		policy       string
+		want         string
+	}{
+		{"keep", "https://example.com/?a=1&b=2", "b=3&c=4", forwardKeep, "https://example.com/?a=1&b=2&c=4"},
+		{"override", "https://example.com/?a=1&b=2", "b=3&c=4", forwardOverride, "https://example.com/?a=1&b=3&c=4"},
+		{"append", "https://example.com/?a=1&b=2", "b=3&c=4", forwardAppend, "https://example.com/?a=1&b=2&b=3&c=4"},
+		{"no destination query", "https://example.com/p", "utm_source=mail", forwardKeep, "https://example.com/p?utm_source=mail"},
+		{"destination encoding untouched", "https://example.com/?q=a+b%21", "x=%20y", forwardKeep, "https://example.com/?q=a+b%21&x=+y"},
+		{"broken visitor pair dropped", "https://example.com/", "bad=%zz&ok=1", forwardKeep, "https://example.com/?ok=1"},
+		{"fragment stays last", "https://example.com/p#top", "a=1", forwardOverride, "https://example.com/p?a=1#top"},
+		{"visitor cannot break out of a value", "https://example.com/", "a=1%26admin%3D1", forwardAppend, "https://example.com/?a=1%26admin%3D1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := forwardQuery(test.destination, test.visitorQuery, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("forwardQuery(%q, %q, %s) = %q, want %q", test.destination, test.visitorQuery, test.policy, got, test.want)
+			}
+		})
+	}
+}
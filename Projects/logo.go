@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	maxLogoBytes       = 256 << 10
+	maxLogoSide        = 1024
+	maxLogoAspect      = 4    // wider or taller than 4:1 leaves nothing recognizable at QR sizes
+	qrDefaultLogoScale = 20   // logo width as a percentage of the symbol width
+	qrMaxLogoCoverage  = 0.15 // share of the symbol a padded logo may hide, level H recovers about 30% of codewords
+)
+
+// qrLogo is a decoded link logo ready to be composited
+type qrLogo struct {
+	img   image.Image
+	data  []byte
+	mime  string
+	scale int
+}
+
+// decodeLogo checks an uploaded logo's format and dimensions before decoding all of it
+func decodeLogo(data []byte) (image.Image, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("logo must be a PNG, JPEG or GIF image")
+	}
+	if cfg.Width > maxLogoSide || cfg.Height > maxLogoSide {
+		return nil, fmt.Errorf("logo is %dx%d, at most %dx%d is allowed", cfg.Width, cfg.Height, maxLogoSide, maxLogoSide)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 ||
+		cfg.Width > maxLogoAspect*cfg.Height || cfg.Height > maxLogoAspect*cfg.Width {
+		return nil, fmt.Errorf("logo aspect ratio must be within %d:1", maxLogoAspect)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("logo is not a valid %s image", format)
+	}
+	return img, nil
+}
+
+// loadQRLogo returns the logo to composite into shortCode's QR code, nil when it has none or logo=0 asked for a plain code
+func loadQRLogo(r *http.Request, shortCode string) (*qrLogo, error) {
+	if r.URL.Query().Get("logo") == "0" {
+		return nil, nil
+	}
+	data, err := store.Logo(shortCode)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	img, err := decodeLogo(data)
+	if err != nil {
+		return nil, err
+	}
+	logo := &qrLogo{img: img, data: data, mime: http.DetectContentType(data), scale: qrDefaultLogoScale}
+	if value := r.URL.Query().Get("logo_scale"); value != "" {
+		logo.scale, err = strconv.Atoi(value)
+		if err != nil || logo.scale < 5 || logo.scale > 50 {
+			return nil, errInvalidLogoScale
+		}
+	}
+	return logo, nil
+}
+
+var errInvalidLogoScale = qrOptionError("logo_scale must be a percentage of the code width between 5 and 50")
+
+// logoBox is where the logo goes in module units, centered and padded by one module of background
+func logoBox(bitmap [][]bool, opts qrOptions) (x, y, w, h float64) {
+	modules := float64(len(bitmap))
+	symbol := modules - 2*float64(opts.Border)
+	bounds := opts.Logo.img.Bounds()
+	w = symbol * float64(opts.Logo.scale) / 100
+	h = w * float64(bounds.Dy()) / float64(bounds.Dx())
+	if bounds.Dy() > bounds.Dx() {
+		h = symbol * float64(opts.Logo.scale) / 100
+		w = h * float64(bounds.Dx()) / float64(bounds.Dy())
+	}
+	w, h = w+2, h+2
+	return (modules - w) / 2, (modules - h) / 2, w, h
+}
+
+// checkLogoCoverage refuses a logo that would hide more of the symbol than error correction can make up for
+func checkLogoCoverage(bitmap [][]bool, opts qrOptions) error {
+	if opts.Logo == nil {
+		return nil
+	}
+	symbol := float64(len(bitmap) - 2*opts.Border)
+	_, _, w, h := logoBox(bitmap, opts)
+	if coverage := w * h / (symbol * symbol); coverage > qrMaxLogoCoverage {
+		return qrOptionError(fmt.Sprintf("the logo would cover %.0f%% of the code, at most %.0f%% stays scannable; lower logo_scale",
+			coverage*100, qrMaxLogoCoverage*100))
+	}
+	return nil
+}
+
+// withLogo paints the padded logo box over the middle of a rendered PNG code
+func withLogo(code *image.Paletted, bitmap [][]bool, opts qrOptions) *image.RGBA {
+	out := image.NewRGBA(code.Bounds())
+	draw.Draw(out, out.Bounds(), code, image.Point{}, draw.Src)
+
+	perModule := float64(code.Bounds().Dx()) / float64(len(bitmap))
+	x, y, w, h := logoBox(bitmap, opts)
+	box := image.Rect(int(x*perModule), int(y*perModule), int(math.Ceil((x+w)*perModule)), int(math.Ceil((y+h)*perModule)))
+	draw.Draw(out, box, image.NewUniform(opts.Background), image.Point{}, draw.Src)
+
+	pad := int(math.Round(perModule))
+	inner := box.Inset(pad)
+	if inner.Empty() {
+		return out
+	}
+	draw.Draw(out, inner, scaleImage(opts.Logo.img, inner.Dx(), inner.Dy()), image.Point{}, draw.Over)
+	return out
+}
+
+// scaleImage resizes by averaging every source pixel that falls under each destination pixel
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	for dy := 0; dy < height; dy++ {
+		sy0 := bounds.Min.Y + dy*bounds.Dy()/height
+		sy1 := max(bounds.Min.Y+(dy+1)*bounds.Dy()/height, sy0+1)
+		for dx := 0; dx < width; dx++ {
+			sx0 := bounds.Min.X + dx*bounds.Dx()/width
+			sx1 := max(bounds.Min.X+(dx+1)*bounds.Dx()/width, sx0+1)
+			var r, g, b, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			dst.SetRGBA64(dx, dy, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// svgLogo is the logo box for the SVG renderer, the original image is embedded as a data URI
+func svgLogo(bitmap [][]bool, opts qrOptions) string {
+	x, y, w, h := logoBox(bitmap, opts)
+	return fmt.Sprintf(`<rect x="%.3f" y="%.3f" width="%.3f" height="%.3f"%s/>`+"\n"+
+		`<image x="%.3f" y="%.3f" width="%.3f" height="%.3f" preserveAspectRatio="xMidYMid meet" href="data:%s;base64,%s"/>`+"\n",
+		x, y, w, h, svgFill(opts.Background),
+		x+1, y+1, w-2, h-2, opts.Logo.mime, base64.StdEncoding.EncodeToString(opts.Logo.data))
+}
+
+// handleLinkLogo serves /api/v1/links/<code>/logo: GET the logo, PUT a new one as the raw body, DELETE it
+func handleLinkLogo(w http.ResponseWriter, r *http.Request, shortCode string) {
+	record, exists := store.Lookup(shortCode)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		logo, err := store.Logo(shortCode)
+		if err != nil {
+			fmt.Printf("Error loading logo for %s: %v\n", shortCode, err)
+			writeJSONError(w, http.StatusInternalServerError, "error loading logo")
+			return
+		}
+		if logo == nil {
+			writeJSONError(w, http.StatusNotFound, "link has no logo")
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(logo))
+		_, err = w.Write(logo)
+		if err != nil {
+			return
+		}
+		return
+	case http.MethodPut, http.MethodDelete:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !ownsLink(r, record) {
+		writeJSONError(w, http.StatusForbidden, "only the owner can change the logo of this link")
+		return
+	}
+
+	var logo []byte
+	if r.Method == http.MethodPut {
+		var err error
+		logo, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxLogoBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("logo must be at most %d KB", maxLogoBytes>>10))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if _, err := decodeLogo(logo); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	err := store.SetLogo(shortCode, logo)
+	if errors.Is(err, errLinkNotFound) {
+		writeJSONError(w, http.StatusNotFound, "link not found")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error saving logo for %s: %v\n", shortCode, err)
+		writeJSONError(w, http.StatusInternalServerError, "error saving logo")
+		return
+	}
+	qrCodes.Invalidate(shortCode)
+	w.WriteHeader(http.StatusNoContent)
+}
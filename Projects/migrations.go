@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// migration is one numbered schema change; versions must be consecutive starting at 1
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users and urls",
+		up: `
+            CREATE TABLE IF NOT EXISTS users (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                username TEXT UNIQUE NOT NULL,
+                password TEXT NOT NULL
+            );
+            CREATE TABLE IF NOT EXISTS urls (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                user_id INTEGER,
+                short_code TEXT UNIQUE NOT NULL,
+                long_url TEXT NOT NULL,
+                custom_name TEXT,
+                expires_at DATETIME,
+                clicks INTEGER DEFAULT 0,
+                FOREIGN KEY (user_id) REFERENCES users(id)
+            );
+        `,
+		down: `
+            DROP TABLE urls;
+            DROP TABLE users;
+        `,
+	},
+	{
+		version: 2,
+		name:    "add click_events",
+		up: `
+            CREATE TABLE click_events (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                short_code TEXT NOT NULL,
+                clicked_at DATETIME NOT NULL,
+                referrer TEXT,
+                user_agent TEXT,
+                ip_hash TEXT,
+                accept_language TEXT
+            );
+            CREATE INDEX idx_click_events_code_time ON click_events (short_code, clicked_at);
+        `,
+		down: `
+            DROP TABLE click_events;
+        `,
+	},
+	{
+		version: 3,
+		name:    "add urls.created_at",
+		up: `
+            ALTER TABLE urls ADD COLUMN created_at DATETIME;
+            UPDATE urls SET created_at = strftime('%Y-%m-%d %H:%M:%S +0000 UTC', 'now');
+            CREATE INDEX idx_urls_created_at ON urls (created_at);
+        `,
+		down: `
+            DROP INDEX idx_urls_created_at;
+            ALTER TABLE urls DROP COLUMN created_at;
+        `,
+	},
+	{
+		version: 4,
+		name:    "add api_keys",
+		up: `
+            CREATE TABLE api_keys (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                user_id INTEGER NOT NULL,
+                name TEXT NOT NULL DEFAULT '',
+                key_hash TEXT UNIQUE NOT NULL,
+                prefix TEXT NOT NULL,
+                scopes TEXT NOT NULL,
+                created_at DATETIME NOT NULL,
+                expires_at DATETIME,
+                last_used_at DATETIME,
+                revoked_at DATETIME,
+                FOREIGN KEY (user_id) REFERENCES users(id)
+            );
+            CREATE INDEX idx_urls_user_id ON urls (user_id);
+        `,
+		down: `
+            DROP INDEX idx_urls_user_id;
+            DROP TABLE api_keys;
+        `,
+	},
+	{
+		version: 5,
+		name:    "add api_keys.rate_limit",
+		up: `
+            ALTER TABLE api_keys ADD COLUMN rate_limit TEXT;
+        `,
+		down: `
+            ALTER TABLE api_keys DROP COLUMN rate_limit;
+        `,
+	},
+	{
+		version: 6,
+		name:    "add archived_urls",
+		up: `
+            CREATE TABLE archived_urls (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                user_id INTEGER,
+                short_code TEXT UNIQUE NOT NULL,
+                long_url TEXT NOT NULL,
+                custom_name TEXT,
+                expires_at DATETIME,
+                clicks INTEGER DEFAULT 0,
+                created_at DATETIME,
+                archived_at DATETIME NOT NULL
+            );
+        `,
+		down: `
+            DROP TABLE archived_urls;
+        `,
+	},
+	{
+		version: 7,
+		name:    "add link_logos",
+		up: `
+            CREATE TABLE link_logos (
+                short_code TEXT PRIMARY KEY,
+                image BLOB NOT NULL,
+                updated_at DATETIME NOT NULL
+            );
+        `,
+		down: `
+            DROP TABLE link_logos;
+        `,
+	},
+	{
+		version: 8,
+		name:    "add urls.options",
+		up: `
+            ALTER TABLE urls ADD COLUMN options TEXT NOT NULL DEFAULT '{}';
+            ALTER TABLE archived_urls ADD COLUMN options TEXT NOT NULL DEFAULT '{}';
+        `,
+		down: `
+            ALTER TABLE archived_urls DROP COLUMN options;
+            ALTER TABLE urls DROP COLUMN options;
+        `,
+	},
+	{
+		version: 9,
+		name:    "add urls.max_clicks",
+		up: `
+            ALTER TABLE urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+            ALTER TABLE archived_urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+        `,
+		down: `
+            ALTER TABLE archived_urls DROP COLUMN max_clicks;
+            ALTER TABLE urls DROP COLUMN max_clicks;
+        `,
+	},
+	{
+		version: 10,
+		name:    "add urls.not_before",
+		up: `
+            ALTER TABLE urls ADD COLUMN not_before DATETIME;
+            ALTER TABLE archived_urls ADD COLUMN not_before DATETIME;
+        `,
+		down: `
+            ALTER TABLE archived_urls DROP COLUMN not_before;
+            ALTER TABLE urls DROP COLUMN not_before;
+        `,
+	},
+	{
+		// deleting a link used to leave its clicks behind for the next link with that code
+		version: 11,
+		name:    "drop click_events of deleted links",
+		up: `
+            DELETE FROM click_events WHERE short_code NOT IN (
+                SELECT short_code FROM urls UNION SELECT short_code FROM archived_urls
+            );
+        `,
+		down: `
+            SELECT 1;
+        `,
+	},
+	{
+		// migration 3 used to backfill created_at as RFC 3339, the driver writes time.Time.String(),
+		// and the created_after/created_before text comparisons need a single format
+		version: 12,
+		name:    "rewrite backfilled created_at in the driver's format",
+		up: `
+            UPDATE urls SET created_at = replace(replace(created_at, 'T', ' '), 'Z', ' +0000 UTC')
+            WHERE created_at GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]Z';
+            UPDATE archived_urls SET created_at = replace(replace(created_at, 'T', ' '), 'Z', ' +0000 UTC')
+            WHERE created_at GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]Z';
+        `,
+		down: `
+            SELECT 1;
+        `,
+	},
+	{
+		version: 13,
+		name:    "add secrets",
+		up: `
+            CREATE TABLE secrets (
+                name TEXT PRIMARY KEY,
+                value TEXT NOT NULL
+            );
+        `,
+		down: `
+            DROP TABLE secrets;
+        `,
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at DATETIME NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// migrateUp applies every pending migration up to and including target
+func migrateUp(db *sql.DB, target int) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		fmt.Printf("Applying migration %d: %s\n", m.version, m.name)
+		err := runMigration(db, m.up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				m.version, m.name, time.Now().UTC(),
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the given number of applied migrations, newest first
+func migrateDown(db *sql.DB, steps int) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.version > current {
+			continue
+		}
+		fmt.Printf("Rolling back migration %d: %s\n", m.version, m.name)
+		err := runMigration(db, m.down, func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of migration %d failed: %v", m.version, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+func runMigration(db *sql.DB, statements string, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(statements); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func printMigrationStatus(db *sql.DB) error {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if appliedAt, ok := applied[m.version]; ok {
+			fmt.Printf("%4d  %-30s applied %s\n", m.version, m.name, appliedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%4d  %-30s pending\n", m.version, m.name)
+		}
+	}
+	for version := range applied {
+		if version > latestSchemaVersion() {
+			fmt.Printf("%4d  %-30s unknown to this binary\n", version, "?")
+		}
+	}
+	return nil
+}
+
+// runMigrateCommand handles "migrate up [version]", "migrate down [steps]" and "migrate status"
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [version] | down [steps] | status")
+	}
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	number := func(fallback int) (int, error) {
+		if len(args) < 2 {
+			return fallback, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number %q", args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "up":
+		target, err := number(latestSchemaVersion())
+		if err != nil {
+			return err
+		}
+		return migrateUp(db, target)
+	case "down":
+		steps, err := number(1)
+		if err != nil {
+			return err
+		}
+		return migrateDown(db, steps)
+	case "status":
+		return printMigrationStatus(db)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
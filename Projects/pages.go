@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// pages holds one template set per page, each parsed together with the shared layout
+var pages = map[string]*template.Template{
+	"home":      parsePage("home"),
+	"shortened": parsePage("shortened"),
+	"unlock":    parsePage("unlock"),
+	"pending":   parsePage("pending"),
+	"expired":   parsePage("expired"),
+}
+
+type homeRow struct {
+	ShortCode string
+	LongURL   string
+	Clicks    int
+	QRURL     string
+}
+
+type homePage struct {
+	CSRFToken string
+	Links     []homeRow
+}
+
+type unlockPage struct {
+	Action    string
+	CSRFToken string
+	Error     string
+}
+
+type shortenedPage struct {
+	ShortCode string
+	ShortURL  string
+	QRURL     string
+}
+
+func parsePage(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(template.FuncMap{"asset": assetPath}).
+		ParseFS(templateFiles, "templates/layout.html", "templates/"+name+".html"))
+}
+
+func renderPage(w http.ResponseWriter, name string, data any) {
+	renderPageStatus(w, http.StatusOK, name, data)
+}
+
+// renderPageStatus executes a page into a buffer first so a template error still gets a clean 500
+func renderPageStatus(w http.ResponseWriter, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := pages[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		fmt.Printf("Error rendering %s page: %v\n", name, err)
+		http.Error(w, "Error generating response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		fmt.Printf("Error writing %s page: %v\n", name, err)
+	}
+}
+
+func qrURLFor(r *http.Request, shortCode string) string {
+	return baseURLFor(r) + "/qr?code=" + url.QueryEscape(shortCode)
+}
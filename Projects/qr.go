@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	qrMinSize       = 64
+	qrMaxSize       = 4096
+	qrDefaultSize   = 256
+	qrMaxBorder     = 32
+	qrDefaultBorder = 4 // the quiet zone the QR spec asks for
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrOptions is how a QR code is drawn, parsed from the /qr query string
+type qrOptions struct {
+	Size       int
+	Level      string
+	Foreground color.RGBA
+	Background color.RGBA
+	Border     int
+	Format     string
+	ANSI       bool
+	Download   bool
+	Logo       *qrLogo
+}
+
+// qrFormats maps each format= value to its content type and file extension
+var qrFormats = map[string]struct{ contentType, ext string }{
+	"png": {"image/png", "png"},
+	"svg": {"image/svg+xml", "svg"},
+	"txt": {"text/plain; charset=utf-8", "txt"},
+}
+
+func parseQROptions(r *http.Request) (qrOptions, error) {
+	query := r.URL.Query()
+	opts := qrOptions{
+		Size:       qrDefaultSize,
+		Level:      "M",
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		Border:     qrDefaultBorder,
+		Format:     "png",
+		ANSI:       query.Get("ansi") == "1",
+		Download:   query.Get("download") == "1",
+	}
+	var err error
+	if value := query.Get("size"); value != "" {
+		opts.Size, err = strconv.Atoi(value)
+		if err != nil || opts.Size < qrMinSize || opts.Size > qrMaxSize {
+			return opts, fmt.Errorf("size must be a number of pixels between %d and %d", qrMinSize, qrMaxSize)
+		}
+	}
+	if value := query.Get("level"); value != "" {
+		opts.Level = strings.ToUpper(value)
+		if _, ok := qrLevels[opts.Level]; !ok {
+			return opts, fmt.Errorf("level must be one of L, M, Q, H")
+		}
+	}
+	if value := query.Get("fg"); value != "" {
+		if opts.Foreground, err = parseHexColor(value); err != nil {
+			return opts, fmt.Errorf("fg: %v", err)
+		}
+	}
+	if value := query.Get("bg"); value != "" {
+		if opts.Background, err = parseHexColor(value); err != nil {
+			return opts, fmt.Errorf("bg: %v", err)
+		}
+	}
+	if opts.Foreground == opts.Background {
+		return opts, fmt.Errorf("fg and bg must differ")
+	}
+	if value := query.Get("border"); value != "" {
+		opts.Border, err = strconv.Atoi(value)
+		if err != nil || opts.Border < 0 || opts.Border > qrMaxBorder {
+			return opts, fmt.Errorf("border must be a number of modules between 0 and %d", qrMaxBorder)
+		}
+	}
+	if value := query.Get("format"); value != "" {
+		opts.Format = strings.ToLower(value)
+		if _, ok := qrFormats[opts.Format]; !ok {
+			return opts, fmt.Errorf("format must be one of png, svg, txt")
+		}
+	}
+	return opts, nil
+}
+
+// parseHexColor reads RGB, RRGGBB or RRGGBBAA with an optional leading #
+func parseHexColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 3 {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+	if len(value) != 8 {
+		return color.RGBA{}, fmt.Errorf("color %q must be hex RGB, RRGGBB or RRGGBBAA", value)
+	}
+	n, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("color %q must be hex RGB, RRGGBB or RRGGBBAA", value)
+	}
+	return color.RGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// qrBitmap encodes content and surrounds the symbol with border modules of quiet zone
+func qrBitmap(content string, opts qrOptions) ([][]bool, error) {
+	qr, err := qrcode.New(content, qrLevels[opts.Level])
+	if err != nil {
+		return nil, err
+	}
+	qr.DisableBorder = true
+	symbol := qr.Bitmap()
+
+	size := len(symbol) + 2*opts.Border
+	bitmap := make([][]bool, size)
+	for y := range bitmap {
+		bitmap[y] = make([]bool, size)
+		if y >= opts.Border && y < opts.Border+len(symbol) {
+			copy(bitmap[y][opts.Border:], symbol[y-opts.Border])
+		}
+	}
+	return bitmap, nil
+}
+
+// qrImage scales the bitmap to a size x size image, growing it if there are more modules than pixels
+func qrImage(bitmap [][]bool, opts qrOptions) *image.Paletted {
+	modules := len(bitmap)
+	size := opts.Size
+	if size < modules {
+		size = modules
+	}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{opts.Background, opts.Foreground})
+	for y := 0; y < size; y++ {
+		row := bitmap[y*modules/size]
+		for x := 0; x < size; x++ {
+			if row[x*modules/size] {
+				img.Pix[img.PixOffset(x, y)] = 1
+			}
+		}
+	}
+	return img
+}
+
+// renderQR draws the bitmap in opts.Format, every format works from the same modules so they scan identically
+func renderQR(bitmap [][]bool, opts qrOptions) ([]byte, error) {
+	switch opts.Format {
+	case "svg":
+		return qrSVG(bitmap, opts), nil
+	case "txt":
+		return qrText(bitmap, opts), nil
+	default:
+		var img image.Image = qrImage(bitmap, opts)
+		if opts.Logo != nil {
+			img = withLogo(img.(*image.Paletted), bitmap, opts)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// qrSVG draws one unit per module with a path per row of dark runs, so it stays sharp at any print size
+func qrSVG(bitmap [][]bool, opts qrOptions) []byte {
+	modules := len(bitmap)
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		opts.Size, opts.Size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d"%s/>`+"\n", modules, modules, svgFill(opts.Background))
+	fmt.Fprintf(&buf, `<path%s d="`, svgFill(opts.Foreground))
+	for y, row := range bitmap {
+		for x := 0; x < modules; {
+			if !row[x] {
+				x++
+				continue
+			}
+			run := 1
+			for x+run < modules && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", x, y, run, run)
+			x += run
+		}
+	}
+	buf.WriteString(`"/>` + "\n")
+	if opts.Logo != nil {
+		buf.WriteString(svgLogo(bitmap, opts))
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+func svgFill(c color.RGBA) string {
+	fill := fmt.Sprintf(` fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A != 0xff {
+		fill += fmt.Sprintf(` fill-opacity="%.3f"`, float64(c.A)/0xff)
+	}
+	return fill
+}
+
+// qrText packs two module rows into each line with half blocks; ansi adds true-color escapes
+// using fg/bg so the code scans on dark terminals too
+func qrText(bitmap [][]bool, opts qrOptions) []byte {
+	var buf bytes.Buffer
+	for y := 0; y < len(bitmap); y += 2 {
+		if opts.ANSI {
+			fmt.Fprintf(&buf, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm",
+				opts.Foreground.R, opts.Foreground.G, opts.Foreground.B,
+				opts.Background.R, opts.Background.G, opts.Background.B)
+		}
+		for x := range bitmap[y] {
+			top := bitmap[y][x]
+			bottom := y+1 < len(bitmap) && bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		if opts.ANSI {
+			buf.WriteString("\x1b[0m")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// qrOptionError means the requested options cannot work for a link, as opposed to a server-side failure
+type qrOptionError string
+
+func (e qrOptionError) Error() string {
+	return string(e)
+}
+
+// renderLinkQR draws the QR code for shortCode in opts, adding the link's logo where the format allows one
+func renderLinkQR(r *http.Request, shortCode string, opts qrOptions) ([]byte, error) {
+	// text codes have no room for a logo; everything else gets it at the highest ECC level
+	if opts.Format != "txt" {
+		var err error
+		if opts.Logo, err = loadQRLogo(r, shortCode); err != nil {
+			return nil, err
+		}
+		if opts.Logo != nil {
+			opts.Level = "H"
+		}
+	}
+
+	bitmap, err := qrBitmap(shortURLFor(r, shortCode), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLogoCoverage(bitmap, opts); err != nil {
+		return nil, err
+	}
+	return renderQR(bitmap, opts)
+}
+
+func handleQRCode(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.URL.Query().Get("code")
+	if shortCode == "" {
+		http.Error(w, "Missing short code", http.StatusBadRequest)
+		return
+	}
+
+	if _, exists := store.Lookup(shortCode); !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	opts, err := parseQROptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	key := qrCacheKey{
+		shortCode:  shortCode,
+		shortURL:   shortURLFor(r, shortCode),
+		size:       opts.Size,
+		level:      opts.Level,
+		foreground: opts.Foreground,
+		background: opts.Background,
+		border:     opts.Border,
+		format:     opts.Format,
+		ansi:       opts.ANSI,
+		logo:       query.Get("logo"),
+		logoScale:  query.Get("logo_scale"),
+	}
+	cached, ok := qrCodes.Get(key)
+	if !ok {
+		body, err := renderLinkQR(r, shortCode, opts)
+		var optionErr qrOptionError
+		if errors.As(err, &optionErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error generating QR code for %s: %v\n", shortCode, err)
+			http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+			return
+		}
+		cached = qrCodes.Put(key, body)
+	}
+
+	// links can change, so clients revalidate every time and mostly get a 304
+	w.Header().Set("ETag", cached.etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagListed(r.Header.Get("If-None-Match"), cached.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	format := qrFormats[opts.Format]
+	w.Header().Set("Content-Type", format.contentType)
+	if opts.Download {
+		filename := fmt.Sprintf("qr-%s-%d.%s", shortCode, opts.Size, format.ext)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	_, err = w.Write(cached.body)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxQRExport = 1000
+
+// qrExportRequest picks the links to export, either by code or by owner; QR options come from the query string like /qr
+type qrExportRequest struct {
+	Codes []string `json:"codes"`
+	Owner string   `json:"owner"`
+	State string   `json:"state"`
+}
+
+// exportLinks resolves the request to links of the calling key's user, an error is a message for the client
+func (req qrExportRequest) exportLinks(r *http.Request) ([]Link, int, error) {
+	if len(req.Codes) > 0 && req.Owner != "" {
+		return nil, http.StatusBadRequest, errors.New("give either codes or owner, not both")
+	}
+
+	if len(req.Codes) > 0 {
+		if len(req.Codes) > maxQRExport {
+			return nil, http.StatusBadRequest, fmt.Errorf("at most %d codes per export", maxQRExport)
+		}
+		links := make([]Link, 0, len(req.Codes))
+		var missing []string
+		for _, code := range req.Codes {
+			record, exists := store.Lookup(code)
+			if !exists || !readsLink(r, record) {
+				missing = append(missing, code)
+				continue
+			}
+			links = append(links, Link{code, record})
+		}
+		if len(missing) > 0 {
+			return nil, http.StatusNotFound, fmt.Errorf("unknown short codes: %s", strings.Join(missing, ", "))
+		}
+		return links, 0, nil
+	}
+
+	if req.Owner == "" {
+		return nil, http.StatusBadRequest, errors.New("codes or owner is required")
+	}
+	owner, err := userID(req.Owner)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if owner != keyFromContext(r).UserID {
+		return nil, http.StatusForbidden, errors.New("keys can only export their own user's links")
+	}
+	filter := LinkFilter{UserID: owner, State: linkStateActive, Limit: maxQRExport + 1}
+	switch req.State {
+	case "", linkStateActive:
+	case "all":
+		filter.State = ""
+	case linkStateExpired:
+		filter.State = linkStateExpired
+	default:
+		return nil, http.StatusBadRequest, errors.New("state must be active, expired or all")
+	}
+	links, _, err := store.List(filter)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(links) > maxQRExport {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s has more than %d links, export them by code in parts", req.Owner, maxQRExport)
+	}
+	return links, 0, nil
+}
+
+// exportFilename turns a short code into a safe, unique file name inside the archive
+func exportFilename(shortCode, ext string, used map[string]bool) string {
+	base := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, shortCode)
+	name := base + "." + ext
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d.%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// handleQRExport streams a ZIP with one QR code per link and a manifest.csv; a code that fails to
+// render is listed in the manifest with its error instead of aborting the whole archive
+func handleQRExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req qrExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	opts, err := parseQROptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	links, status, err := req.exportLinks(r)
+	if status == http.StatusInternalServerError {
+		fmt.Printf("Error listing links for QR export: %v\n", err)
+		writeJSONError(w, status, "error listing links")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	filename := fmt.Sprintf("qr-export-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	// a big export renders for longer than the server's write timeout, so the deadline moves with
+	// every file instead: the whole archive may take as long as it needs but a stalled client cannot
+	controller := http.NewResponseController(w)
+	extendDeadline := func() {
+		if err := controller.SetWriteDeadline(time.Now().Add(config.WriteTimeout)); err != nil {
+			fmt.Printf("Error extending write deadline for QR export: %v\n", err)
+		}
+	}
+
+	archive := zip.NewWriter(w)
+	var manifest strings.Builder
+	rows := csv.NewWriter(&manifest)
+	rows.Write([]string{"file", "short_code", "short_url", "long_url", "error"})
+
+	used := map[string]bool{"manifest.csv": true}
+	ext := qrFormats[opts.Format].ext
+	for _, link := range links {
+		extendDeadline()
+		shortURL := shortURLFor(r, link.ShortCode)
+		body, err := renderLinkQR(r, link.ShortCode, opts)
+		if err != nil {
+			var optionErr qrOptionError
+			if !errors.As(err, &optionErr) {
+				fmt.Printf("Error generating QR code for %s: %v\n", link.ShortCode, err)
+				err = errors.New("failed to generate QR code")
+			}
+			rows.Write([]string{"", link.ShortCode, shortURL, link.LongURL, err.Error()})
+			continue
+		}
+		name := exportFilename(link.ShortCode, ext, used)
+		file, err := archive.Create(name)
+		if err == nil {
+			_, err = file.Write(body)
+		}
+		if err != nil {
+			fmt.Printf("Error writing QR export: %v\n", err)
+			return
+		}
+		rows.Write([]string{name, link.ShortCode, shortURL, link.LongURL, ""})
+	}
+
+	rows.Flush()
+	extendDeadline()
+	file, err := archive.Create("manifest.csv")
+	if err == nil {
+		_, err = file.Write([]byte(manifest.String()))
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		fmt.Printf("Error writing QR export: %v\n", err)
+	}
+}
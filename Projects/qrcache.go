@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"image/color"
+	"strings"
+	"sync"
+)
+
+// qrCodes holds recently rendered QR codes, set up in main once the configured size is known
+var qrCodes *qrCache
+
+// qrCacheKey is everything that changes the rendered bytes of a code; the short URL is part of it
+// because without -base-url it follows the Host header
+type qrCacheKey struct {
+	shortCode  string
+	shortURL   string
+	size       int
+	level      string
+	foreground color.RGBA
+	background color.RGBA
+	border     int
+	format     string
+	ansi       bool
+	logo       string
+	logoScale  string
+}
+
+type qrCacheEntry struct {
+	key  qrCacheKey
+	body []byte
+	etag string
+}
+
+// qrCache is a fixed-size LRU of rendered codes, the front of order is the most recently used
+type qrCache struct {
+	mutex   sync.Mutex
+	limit   int
+	order   *list.List
+	entries map[qrCacheKey]*list.Element
+}
+
+func newQRCache(limit int) *qrCache {
+	return &qrCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[qrCacheKey]*list.Element),
+	}
+}
+
+func (cache *qrCache) Get(key qrCacheKey) (qrCacheEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return qrCacheEntry{}, false
+	}
+	cache.order.MoveToFront(element)
+	return *element.Value.(*qrCacheEntry), true
+}
+
+// Put stores body under key and returns the entry with its ETag, evicting the least recently used code when full
+func (cache *qrCache) Put(key qrCacheKey, body []byte) qrCacheEntry {
+	sum := sha256.Sum256(body)
+	entry := &qrCacheEntry{key: key, body: body, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return *entry
+	}
+	cache.entries[key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.limit {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*qrCacheEntry).key)
+	}
+	return *entry
+}
+
+// Invalidate drops every cached rendering of shortCode, called whenever the link or its logo changes
+func (cache *qrCache) Invalidate(shortCode string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for element := cache.order.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*qrCacheEntry); entry.key.shortCode == shortCode {
+			cache.order.Remove(element)
+			delete(cache.entries, entry.key)
+		}
+		element = next
+	}
+}
+
+// etagListed reports whether an If-None-Match header names etag or is a wildcard
+func etagListed(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
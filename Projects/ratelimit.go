@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	webLimiter      *rateLimiter
+	apiLimiter      *rateLimiter
+	redirectLimiter *rateLimiter
+	unlockLimiter   *rateLimiter // keyed by short code, against password guessing
+)
+
+// idle buckets are refilled anyway, so they are dropped once this old
+const bucketIdleTimeout = 10 * time.Minute
+
+// rateLimit allows Burst requests at once, refilled at Burst per Per; a zero Burst means unlimited
+type rateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+func (limit rateLimit) String() string {
+	if limit.Burst == 0 {
+		return "unlimited"
+	}
+	switch limit.Per {
+	case time.Second:
+		return fmt.Sprintf("%d/s", limit.Burst)
+	case time.Minute:
+		return fmt.Sprintf("%d/m", limit.Burst)
+	case time.Hour:
+		return fmt.Sprintf("%d/h", limit.Burst)
+	}
+	return fmt.Sprintf("%d/%s", limit.Burst, limit.Per)
+}
+
+// parseRateLimit reads "<count>/<unit>" where unit is s, m, h or any time.ParseDuration value,
+// "0" turns limiting off
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "0" || value == "" {
+		return rateLimit{}, nil
+	}
+	count, unit, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit %q must look like 60/m", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst < 0 {
+		return rateLimit{}, fmt.Errorf("invalid request count in rate limit %q", value)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		per, err = time.ParseDuration(unit)
+		if err != nil || per <= 0 {
+			return rateLimit{}, fmt.Errorf("invalid period in rate limit %q", value)
+		}
+	}
+	return rateLimit{Burst: burst, Per: per}, nil
+}
+
+// rateLimiterFor builds a limiter from a value the config already validated
+func rateLimiterFor(value string) *rateLimiter {
+	limit, _ := parseRateLimit(value)
+	return newRateLimiter(limit)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client key
+type rateLimiter struct {
+	limit     rateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+type rateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next token when refused
+	Reset      time.Duration // until the bucket is full again
+}
+
+// Allow takes a token from key's bucket, limit overrides the limiter default when it has a Burst
+func (limiter *rateLimiter) Allow(key string, limit rateLimit) rateDecision {
+	if limit.Burst == 0 {
+		limit = limiter.limit
+	}
+	if limit.Burst == 0 {
+		return rateDecision{Allowed: true}
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.sweep(now)
+
+	refill := float64(limit.Burst) / limit.Per.Seconds() // tokens per second
+	bucket, exists := limiter.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*refill)
+	bucket.last = now
+
+	decision := rateDecision{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = time.Duration((1 - bucket.tokens) / refill * float64(time.Second))
+	}
+	decision.Remaining = int(bucket.tokens)
+	decision.Reset = time.Duration((float64(limit.Burst) - bucket.tokens) / refill * float64(time.Second))
+	return decision
+}
+
+// sweep drops buckets nobody used for a while, must be called with the mutex held
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) > bucketIdleTimeout {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// checkRateLimit sets the X-RateLimit headers and answers 429 when key is out of tokens
+func checkRateLimit(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, key string, limit rateLimit) bool {
+	if limiter == nil {
+		return true
+	}
+	decision := limiter.Allow(key, limit)
+	if decision.Limit == 0 {
+		return true
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("X-RateLimit-Reset", ceilSeconds(decision.Reset))
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", ceilSeconds(decision.RetryAfter))
+		apiError(w, r, http.StatusTooManyRequests, "Too many requests")
+		return false
+	}
+	return true
+}
+
+// rateLimitByIP limits anonymous traffic per client address
+func rateLimitByIP(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkRateLimit(w, r, limiter, clientIP(r), rateLimit{}) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// scheduler runs named jobs on fixed intervals until Stop is called
+type scheduler struct {
+	jobs []scheduledJob
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      func()
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{stop: make(chan struct{})}
+}
+
+// Every registers a job, it has to be called before Start
+func (s *scheduler) Every(name string, interval time.Duration, run func()) {
+	s.jobs = append(s.jobs, scheduledJob{name, interval, run})
+}
+
+func (s *scheduler) Start() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+}
+
+func (s *scheduler) loop(job scheduledJob) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.runJob(job)
+		}
+	}
+}
+
+// runJob keeps a panicking job from taking the whole server down
+func (s *scheduler) runJob(job scheduledJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Job %s panicked: %v\n", job.name, r)
+		}
+	}()
+	job.run()
+}
+
+// Stop signals every job and waits for the ones currently running to finish
+func (s *scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// sweepExpiredLinks archives links whose grace period after expiry is over
+func sweepExpiredLinks() {
+	archived, err := store.ArchiveExpired(time.Now().Add(-config.ExpiryGrace))
+	if err != nil {
+		fmt.Printf("Error archiving expired links: %v\n", err)
+		return
+	}
+	if archived > 0 {
+		fmt.Printf("Archived %d expired links\n", archived)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shuttingDown is closed when the server starts draining so long-lived streams can end
+var shuttingDown = make(chan struct{})
+
+func newServer() *http.Server {
+	server := &http.Server{
+		Addr:              config.Listen,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	server.RegisterOnShutdown(func() {
+		close(shuttingDown)
+	})
+	return server
+}
+
+// runServer serves until SIGINT or SIGTERM, then drains requests, stops the background
+// jobs and flushes queued clicks before returning
+func runServer(jobs *scheduler) error {
+	server := newServer()
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Server starting on %s\n", config.Listen)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	jobs.Start()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		fmt.Printf("Error starting server: %s\n", err)
+	case <-signals.Done():
+		fmt.Println("Shutting down...")
+	}
+	stopSignals() // a second signal kills the process right away
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(ctx); shutdownErr != nil && !errors.Is(shutdownErr, http.ErrServerClosed) {
+		fmt.Printf("Error draining requests: %v\n", shutdownErr)
+	}
+
+	start := time.Now()
+	jobs.Stop()
+	clickLog.Close()
+	fmt.Printf("Background work stopped in %s\n", time.Since(start).Round(time.Millisecond))
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:generate go run ./compressstatic static
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticAsset is one file under static with its gzip variant compressed once at startup and its
+// brotli variant, <name>.br, precompressed by go generate
+type staticAsset struct {
+	name        string
+	contentType string
+	hash        string
+	raw         []byte
+	gzip        []byte
+	brotli      []byte
+}
+
+// assets is keyed by both the plain and the fingerprinted name, assetNames maps plain names to fingerprinted ones
+var assets, assetNames = loadStaticAssets()
+
+func loadStaticAssets() (map[string]*staticAsset, map[string]string) {
+	byName := map[string]*staticAsset{}
+	names := map[string]string{}
+	err := fs.WalkDir(staticFiles, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".br") {
+			return err
+		}
+		raw, err := staticFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		asset := &staticAsset{
+			name:        strings.TrimPrefix(p, "static/"),
+			contentType: mime.TypeByExtension(path.Ext(p)),
+			hash:        hex.EncodeToString(sum[:8]),
+			raw:         raw,
+		}
+		if asset.contentType == "" {
+			asset.contentType = "application/octet-stream"
+		}
+		if asset.gzip, err = gzipBytes(raw); err != nil {
+			return err
+		}
+		// a missing .br only means the file didn't shrink, TestBrotliVariantsAreCurrent catches stale ones
+		if brotli, err := staticFiles.ReadFile(p + ".br"); err == nil {
+			asset.brotli = brotli
+		}
+
+		ext := path.Ext(asset.name)
+		fingerprinted := strings.TrimSuffix(asset.name, ext) + "." + asset.hash + ext
+		byName[asset.name] = asset
+		byName[fingerprinted] = asset
+		names[asset.name] = fingerprinted
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("loading embedded static files: %v", err))
+	}
+	return byName, names
+}
+
+// gzipBytes compresses once at startup, nil when gzip would not make the file smaller
+func gzipBytes(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(raw) {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// assetPath is the fingerprinted URL of a static file, used by the templates so a changed file gets a new URL
+func assetPath(name string) string {
+	if fingerprinted, ok := assetNames[name]; ok {
+		return "/static/" + fingerprinted
+	}
+	return "/static/" + name
+}
+
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	asset, ok := assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, encoding := asset.raw, ""
+	switch {
+	case asset.brotli != nil && acceptsEncoding(r, "br"):
+		body, encoding = asset.brotli, "br"
+	case asset.gzip != nil && acceptsEncoding(r, "gzip"):
+		body, encoding = asset.gzip, "gzip"
+	}
+
+	// each encoding is a different representation, so it gets its own validator
+	etag := `"` + asset.hash + `"`
+	if encoding != "" {
+		etag = `"` + asset.hash + "-" + encoding + `"`
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Vary", "Accept-Encoding")
+	if name == asset.name {
+		// the plain name can change contents between releases, so caches have to revalidate it
+		header.Set("Cache-Control", "no-cache")
+	} else {
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), asset.hash) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", asset.contentType)
+	header.Set("Content-Length", fmt.Sprint(len(body)))
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		fmt.Printf("Error writing static file %s: %v\n", name, err)
+	}
+}
+
+// acceptsEncoding reports whether Accept-Encoding lists coding without q=0
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(token), coding) {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// etagMatches checks If-None-Match against any encoding of the asset, all of them share the same content hash
+func etagMatches(ifNoneMatch, hash string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == `"`+hash+`"` || strings.HasPrefix(tag, `"`+hash+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCSS keeps the old stylesheet URL working for pages cached before the move to /static/;
+// the target changes with every stylesheet change, so the redirect must not be cached for good
+func serveCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	http.Redirect(w, r, assetPath("URLShortener.css"), http.StatusFound)
+}
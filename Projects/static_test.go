@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// TestBrotliVariantsAreCurrent fails when a static file changed without rerunning go generate
+func TestBrotliVariantsAreCurrent(t *testing.T) {
+	for name, asset := range assets {
+		if name != asset.name || asset.brotli == nil {
+			continue
+		}
+		raw, err := io.ReadAll(brotli.NewReader(bytes.NewReader(asset.brotli)))
+		if err != nil {
+			t.Errorf("%s.br: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(raw, asset.raw) {
+			t.Errorf("%s.br is stale, run go generate in Projects", name)
+		}
+	}
+}
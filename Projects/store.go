@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+var (
+	errCodeTaken    = errors.New("short code already in use")
+	errLinkNotFound = errors.New("link not found")
+	errClicksPassed = errors.New("max_clicks must be above the link's current clicks")
+)
+
+const (
+	linkStateActive    = "active"
+	linkStateExpired   = "expired"
+	linkStateScheduled = "scheduled" // not expired but not live yet either
+	linkStateArchived  = "archived"  // swept after the grace period or used up, kept for their click history
+)
+
+// Link is a stored record together with its short code
+type Link struct {
+	ShortCode string
+	URLRecord
+}
+
+// LinkFilter narrows List; zero values mean no restriction and a Limit of 0 returns everything
+type LinkFilter struct {
+	Prefix        string
+	UserID        int64
+	State         string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Limit         int
+	Offset        int
+}
+
+// NewLink is a link to create, UserID 0 means it has no owner
+type NewLink struct {
+	LongURL    string
+	ExpiresIn  time.Duration
+	NotBefore  time.Time
+	CustomName string
+	UserID     int64
+	MaxClicks  int
+	Options    LinkOptions
+}
+
+// SaveResult is the outcome for one NewLink, Err is errCodeTaken when its custom name is in use
+type SaveResult struct {
+	ShortCode string
+	Err       error
+}
+
+// LinkUpdate holds the fields a PATCH may change, nil fields are left alone
+type LinkUpdate struct {
+	LongURL   *string
+	ExpiresAt *time.Time
+	NotBefore *time.Time // the zero time makes the link live right away
+	NewCode   *string
+	MaxClicks *int // 0 removes the limit, errClicksPassed if the link already has that many clicks
+	Options   *LinkOptions
+}
+
+// URLStore is everything the handlers need from a storage backend
+type URLStore interface {
+	Save(link NewLink) (string, error)
+	SaveBatch(links []NewLink) ([]SaveResult, error)
+	Lookup(shortCode string) (URLRecord, bool)
+	LookupArchived(shortCode string) (URLRecord, bool)
+	List(filter LinkFilter) ([]Link, int, error) // State archived lists archived links instead of live ones
+	Update(shortCode string, update LinkUpdate) (string, error)
+	// IncrementClicks counts one visit and returns the new total; errLinkNotFound means the visit must
+	// not be served. The click that reaches MaxClicks archives the link in the same step.
+	IncrementClicks(shortCode string) (int, error)
+	IsCustomNameAvailable(name string) bool
+	Delete(shortCode string) error
+	ArchiveExpired(before time.Time) (int, error)
+	RecordClick(event ClickEvent) error
+	ClickStats(shortCode, bucket string) (clickStats, error)
+	SetLogo(shortCode string, logo []byte) error
+	Logo(shortCode string) ([]byte, error)
+	Close() error
+}
+
+func openStore(backend, logPath string) (URLStore, error) {
+	switch backend {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		return NewSQLiteStore(db), nil
+	case "file":
+		return NewFileLogStore(logPath)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+// usedUp reports whether a click-limited link has had all its visits
+func (record URLRecord) usedUp() bool {
+	return record.MaxClicks > 0 && record.Clicks >= record.MaxClicks
+}
+
+func (filter LinkFilter) matches(shortCode string, record URLRecord, now time.Time) bool {
+	if !strings.HasPrefix(shortCode, filter.Prefix) {
+		return false
+	}
+	if filter.UserID != 0 && record.UserID != filter.UserID {
+		return false
+	}
+	switch filter.State {
+	case linkStateActive:
+		if !now.Before(record.ExpiresAt) || now.Before(record.NotBefore) {
+			return false
+		}
+	case linkStateExpired:
+		if now.Before(record.ExpiresAt) {
+			return false
+		}
+	case linkStateScheduled:
+		if !now.Before(record.NotBefore) || !now.Before(record.ExpiresAt) {
+			return false
+		}
+	}
+	if !filter.CreatedAfter.IsZero() && !record.CreatedAt.After(filter.CreatedAfter) {
+		return false
+	}
+	if !filter.CreatedBefore.IsZero() && !record.CreatedAt.Before(filter.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// page cuts the already sorted links down to the filter's offset and limit
+func (filter LinkFilter) page(links []Link) []Link {
+	if filter.Offset >= len(links) {
+		return []Link{}
+	}
+	links = links[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(links) {
+		links = links[:filter.Limit]
+	}
+	return links
+}
+
+// saveOne is Save on top of SaveBatch
+func saveOne(store URLStore, link NewLink) (string, error) {
+	results, err := store.SaveBatch([]NewLink{link})
+	if err != nil {
+		return "", err
+	}
+	return results[0].ShortCode, results[0].Err
+}
+
+func generateShortCode() string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	shortCode := make([]byte, config.CodeLength)
+	for i := range shortCode {
+		shortCode[i] = charset[seededRand.Intn(len(charset))]
+	}
+	return string(shortCode)
+}
+
+// pickShortCode returns customName if given, otherwise a random code that taken reports as free
+func pickShortCode(customName string, taken func(string) (bool, error)) (string, error) {
+	if customName != "" {
+		exists, err := taken(customName)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", errCodeTaken
+		}
+		return customName, nil
+	}
+	for {
+		shortCode := generateShortCode()
+		exists, err := taken(shortCode)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return shortCode, nil
+		}
+	}
+}
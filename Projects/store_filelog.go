@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileLogStore keeps links in memory and appends every change to a JSON-lines log,
+// which is replayed on startup
+type FileLogStore struct {
+	mappings map[string]URLRecord
+	archived map[string]URLRecord
+	events   map[string][]ClickEvent
+	logos    map[string][]byte
+	mutex    sync.RWMutex
+	file     *os.File
+}
+
+type logEntry struct {
+	Op         string       `json:"op"`
+	ShortCode  string       `json:"code"`
+	LongURL    string       `json:"long_url,omitempty"`
+	ExpiresAt  *time.Time   `json:"expires_at,omitempty"`
+	NotBefore  *time.Time   `json:"not_before,omitempty"`
+	CustomName string       `json:"custom_name,omitempty"`
+	CreatedAt  *time.Time   `json:"created_at,omitempty"`
+	NewCode    string       `json:"new_code,omitempty"`
+	UserID     int64        `json:"user_id,omitempty"`
+	MaxClicks  *int         `json:"max_clicks,omitempty"`
+	Event      *ClickEvent  `json:"event,omitempty"`
+	Logo       []byte       `json:"logo,omitempty"`
+	Options    *LinkOptions `json:"options,omitempty"`
+}
+
+const (
+	logOpSave    = "save"
+	logOpUpdate  = "update"
+	logOpClick   = "click"
+	logOpDelete  = "delete"
+	logOpArchive = "archive"
+	logOpEvent   = "event"
+	logOpLogo    = "logo"
+)
+
+// maxLogEntryBytes fits a logo entry, whose logo is base64 in the JSON, with room for the other fields
+const maxLogEntryBytes = maxLogoBytes/3*4 + 64<<10
+
+func NewFileLogStore(path string) (*FileLogStore, error) {
+	store := &FileLogStore{
+		mappings: make(map[string]URLRecord),
+		archived: make(map[string]URLRecord),
+		events:   make(map[string][]ClickEvent),
+		logos:    make(map[string][]byte),
+	}
+	if err := store.replay(path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %v", err)
+	}
+	store.file = file
+	return store, nil
+}
+
+// replay applies every entry in the log. A crash mid-write leaves a torn last line, that line is
+// cut off so the next append starts clean; a bad line anywhere else is real corruption.
+func (store *FileLogStore) replay(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLogEntryBytes)
+	line := 0
+	// tornOffset is where a bad line starts, it is only torn if no line follows it
+	offset, tornOffset := int64(0), int64(-1)
+	var tornErr error
+	for scanner.Scan() {
+		line++
+		if tornOffset >= 0 {
+			return fmt.Errorf("corrupt log entry on line %d: %v", line-1, tornErr)
+		}
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			tornOffset, tornErr = offset, err
+		} else {
+			store.apply(entry)
+		}
+		offset += int64(len(scanner.Bytes())) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if tornOffset >= 0 {
+		fmt.Printf("Dropping torn last log entry on line %d: %v\n", line, tornErr)
+		if err := file.Truncate(tornOffset); err != nil {
+			return fmt.Errorf("failed to truncate log: %v", err)
+		}
+		return nil
+	}
+	// the last entry made it but its newline didn't, finish the line before anything is appended
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read log: %v", err)
+	}
+	if offset > info.Size() {
+		if _, err := file.WriteAt([]byte("\n"), info.Size()); err != nil {
+			return fmt.Errorf("failed to repair log: %v", err)
+		}
+	}
+	return nil
+}
+
+func (store *FileLogStore) apply(entry logEntry) {
+	switch entry.Op {
+	case logOpSave:
+		record := URLRecord{
+			LongURL:    entry.LongURL,
+			CustomName: entry.CustomName,
+			UserID:     entry.UserID,
+		}
+		if entry.MaxClicks != nil {
+			record.MaxClicks = *entry.MaxClicks
+		}
+		if entry.Options != nil {
+			record.Options = *entry.Options
+		}
+		if entry.ExpiresAt != nil {
+			record.ExpiresAt = *entry.ExpiresAt
+		}
+		if entry.NotBefore != nil {
+			record.NotBefore = *entry.NotBefore
+		}
+		if entry.CreatedAt != nil {
+			record.CreatedAt = *entry.CreatedAt
+		}
+		store.mappings[entry.ShortCode] = record
+	case logOpUpdate:
+		if _, exists := store.mappings[entry.ShortCode]; !exists {
+			return
+		}
+		var update LinkUpdate
+		if entry.LongURL != "" {
+			update.LongURL = &entry.LongURL
+		}
+		update.ExpiresAt = entry.ExpiresAt
+		update.NotBefore = entry.NotBefore
+		update.MaxClicks = entry.MaxClicks
+		update.Options = entry.Options
+		if entry.NewCode != "" {
+			update.NewCode = &entry.NewCode
+		}
+		newCode := applyUpdate(store.mappings, store.events, entry.ShortCode, update)
+		moveLogo(store.logos, entry.ShortCode, newCode)
+	case logOpClick:
+		if record, exists := store.mappings[entry.ShortCode]; exists {
+			record.Clicks++
+			store.mappings[entry.ShortCode] = record
+		}
+	case logOpDelete:
+		delete(store.mappings, entry.ShortCode)
+		delete(store.logos, entry.ShortCode)
+		delete(store.events, entry.ShortCode)
+	case logOpArchive:
+		if record, exists := store.mappings[entry.ShortCode]; exists {
+			delete(store.mappings, entry.ShortCode)
+			delete(store.logos, entry.ShortCode)
+			store.archived[entry.ShortCode] = record
+		}
+	case logOpEvent:
+		if entry.Event != nil {
+			store.events[entry.ShortCode] = append(store.events[entry.ShortCode], *entry.Event)
+		}
+	case logOpLogo:
+		if _, exists := store.mappings[entry.ShortCode]; exists {
+			setLogo(store.logos, entry.ShortCode, entry.Logo)
+		}
+	}
+}
+
+// append writes entries to the log in one write and then applies them, must be called with the mutex held
+func (store *FileLogStore) append(entries ...logEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := store.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write log: %v", err)
+	}
+	for _, entry := range entries {
+		store.apply(entry)
+	}
+	return nil
+}
+
+// exists also counts archived codes, they stay reserved so their click history is not inherited
+func (store *FileLogStore) exists(shortCode string) (bool, error) {
+	_, live := store.mappings[shortCode]
+	_, archived := store.archived[shortCode]
+	return live || archived, nil
+}
+
+func (store *FileLogStore) Save(link NewLink) (string, error) {
+	return saveOne(store, link)
+}
+
+// SaveBatch writes all new links to the log in a single write
+func (store *FileLogStore) SaveBatch(links []NewLink) ([]SaveResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().UTC()
+	pending := make(map[string]bool)
+	taken := func(shortCode string) (bool, error) {
+		exists, _ := store.exists(shortCode)
+		return exists || pending[shortCode], nil
+	}
+
+	results := make([]SaveResult, len(links))
+	var entries []logEntry
+	for i, link := range links {
+		shortCode, err := pickShortCode(link.CustomName, taken)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		pending[shortCode] = true
+		expiresAt := now.Add(link.ExpiresIn)
+		entry := logEntry{
+			Op:         logOpSave,
+			ShortCode:  shortCode,
+			LongURL:    link.LongURL,
+			ExpiresAt:  &expiresAt,
+			CreatedAt:  &now,
+			CustomName: link.CustomName,
+			UserID:     link.UserID,
+			Options:    &link.Options,
+		}
+		if link.MaxClicks > 0 {
+			entry.MaxClicks = &link.MaxClicks
+		}
+		if !link.NotBefore.IsZero() {
+			entry.NotBefore = &link.NotBefore
+		}
+		entries = append(entries, entry)
+		results[i].ShortCode = shortCode
+	}
+	if err := store.append(entries...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (store *FileLogStore) Lookup(shortCode string) (URLRecord, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, exists := store.mappings[shortCode]
+	return record, exists
+}
+
+func (store *FileLogStore) LookupArchived(shortCode string) (URLRecord, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, exists := store.archived[shortCode]
+	return record, exists
+}
+
+func (store *FileLogStore) List(filter LinkFilter) ([]Link, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	source := store.mappings
+	if filter.State == linkStateArchived {
+		source = store.archived
+	}
+	links := filterLinks(source, filter)
+	return filter.page(links), len(links), nil
+}
+
+func (store *FileLogStore) Update(shortCode string, update LinkUpdate) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := checkUpdate(store.mappings, store.exists, shortCode, update); err != nil {
+		return "", err
+	}
+	entry := logEntry{
+		Op:        logOpUpdate,
+		ShortCode: shortCode,
+		ExpiresAt: update.ExpiresAt,
+		NotBefore: update.NotBefore,
+		MaxClicks: update.MaxClicks,
+		Options:   update.Options,
+	}
+	if update.LongURL != nil {
+		entry.LongURL = *update.LongURL
+	}
+	if update.NewCode != nil && *update.NewCode != shortCode {
+		entry.NewCode = *update.NewCode
+	}
+	if err := store.append(entry); err != nil {
+		return "", err
+	}
+	if entry.NewCode != "" {
+		return entry.NewCode, nil
+	}
+	return shortCode, nil
+}
+
+func (store *FileLogStore) IncrementClicks(shortCode string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record, exists := store.mappings[shortCode]
+	if !exists {
+		return 0, errLinkNotFound
+	}
+	record.Clicks++
+	// the last click and the archive go out in one write so a replay never sees one without the other
+	entries := []logEntry{{Op: logOpClick, ShortCode: shortCode}}
+	if record.usedUp() {
+		entries = append(entries, logEntry{Op: logOpArchive, ShortCode: shortCode})
+	}
+	if err := store.append(entries...); err != nil {
+		return 0, err
+	}
+	return record.Clicks, nil
+}
+
+func (store *FileLogStore) IsCustomNameAvailable(name string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	exists, _ := store.exists(name)
+	return !exists
+}
+
+func (store *FileLogStore) Delete(shortCode string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, exists := store.mappings[shortCode]; !exists {
+		return nil
+	}
+	return store.append(logEntry{Op: logOpDelete, ShortCode: shortCode})
+}
+
+func (store *FileLogStore) ArchiveExpired(before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var entries []logEntry
+	for shortCode, record := range store.mappings {
+		if record.ExpiresAt.Before(before) {
+			entries = append(entries, logEntry{Op: logOpArchive, ShortCode: shortCode})
+		}
+	}
+	if err := store.append(entries...); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+func (store *FileLogStore) RecordClick(event ClickEvent) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.append(logEntry{Op: logOpEvent, ShortCode: event.ShortCode, Event: &event})
+}
+
+func (store *FileLogStore) ClickStats(shortCode, bucket string) (clickStats, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return computeStats(shortCode, bucket, store.events[shortCode]), nil
+}
+
+func (store *FileLogStore) SetLogo(shortCode string, logo []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exists := store.mappings[shortCode]; !exists {
+		return errLinkNotFound
+	}
+	return store.append(logEntry{Op: logOpLogo, ShortCode: shortCode, Logo: logo})
+}
+
+func (store *FileLogStore) Logo(shortCode string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.logos[shortCode], nil
+}
+
+func (store *FileLogStore) Close() error {
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	return store.file.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps links in a map only, everything is gone on restart
+type MemoryStore struct {
+	mappings map[string]URLRecord
+	archived map[string]URLRecord
+	events   map[string][]ClickEvent
+	logos    map[string][]byte
+	mutex    sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mappings: make(map[string]URLRecord),
+		archived: make(map[string]URLRecord),
+		events:   make(map[string][]ClickEvent),
+		logos:    make(map[string][]byte),
+	}
+}
+
+// exists also counts archived codes, they stay reserved so their click history is not inherited
+func (store *MemoryStore) exists(shortCode string) (bool, error) {
+	_, live := store.mappings[shortCode]
+	_, archived := store.archived[shortCode]
+	return live || archived, nil
+}
+
+func (store *MemoryStore) Save(link NewLink) (string, error) {
+	return saveOne(store, link)
+}
+
+func (store *MemoryStore) SaveBatch(links []NewLink) ([]SaveResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	results := make([]SaveResult, len(links))
+	for i, link := range links {
+		shortCode, err := pickShortCode(link.CustomName, store.exists)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		store.mappings[shortCode] = URLRecord{
+			LongURL:    link.LongURL,
+			NotBefore:  link.NotBefore,
+			ExpiresAt:  now.Add(link.ExpiresIn),
+			CustomName: link.CustomName,
+			CreatedAt:  now,
+			UserID:     link.UserID,
+			MaxClicks:  link.MaxClicks,
+			Options:    link.Options,
+		}
+		results[i].ShortCode = shortCode
+	}
+	return results, nil
+}
+
+func (store *MemoryStore) Lookup(shortCode string) (URLRecord, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, exists := store.mappings[shortCode]
+	return record, exists
+}
+
+func (store *MemoryStore) LookupArchived(shortCode string) (URLRecord, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, exists := store.archived[shortCode]
+	return record, exists
+}
+
+func (store *MemoryStore) List(filter LinkFilter) ([]Link, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	source := store.mappings
+	if filter.State == linkStateArchived {
+		source = store.archived
+	}
+	links := filterLinks(source, filter)
+	return filter.page(links), len(links), nil
+}
+
+func (store *MemoryStore) Update(shortCode string, update LinkUpdate) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := checkUpdate(store.mappings, store.exists, shortCode, update); err != nil {
+		return "", err
+	}
+	newCode := applyUpdate(store.mappings, store.events, shortCode, update)
+	moveLogo(store.logos, shortCode, newCode)
+	return newCode, nil
+}
+
+func (store *MemoryStore) IncrementClicks(shortCode string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	record, exists := store.mappings[shortCode]
+	if !exists {
+		return 0, errLinkNotFound
+	}
+	record.Clicks++
+	store.mappings[shortCode] = record
+	if record.usedUp() {
+		delete(store.mappings, shortCode)
+		delete(store.logos, shortCode)
+		store.archived[shortCode] = record
+	}
+	return record.Clicks, nil
+}
+
+func (store *MemoryStore) IsCustomNameAvailable(name string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	exists, _ := store.exists(name)
+	return !exists
+}
+
+func (store *MemoryStore) Delete(shortCode string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.mappings, shortCode)
+	delete(store.logos, shortCode)
+	// the code is free again, a new link under it must not inherit these clicks
+	delete(store.events, shortCode)
+	return nil
+}
+
+func (store *MemoryStore) ArchiveExpired(before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	moved := archiveExpired(store.mappings, store.archived, before)
+	for _, shortCode := range moved {
+		delete(store.logos, shortCode)
+	}
+	return len(moved), nil
+}
+
+func (store *MemoryStore) RecordClick(event ClickEvent) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.events[event.ShortCode] = append(store.events[event.ShortCode], event)
+	return nil
+}
+
+func (store *MemoryStore) ClickStats(shortCode, bucket string) (clickStats, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return computeStats(shortCode, bucket, store.events[shortCode]), nil
+}
+
+func (store *MemoryStore) SetLogo(shortCode string, logo []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, exists := store.mappings[shortCode]; !exists {
+		return errLinkNotFound
+	}
+	setLogo(store.logos, shortCode, logo)
+	return nil
+}
+
+func (store *MemoryStore) Logo(shortCode string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.logos[shortCode], nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// filterLinks returns every record matching filter, oldest first, before paging
+func filterLinks(mappings map[string]URLRecord, filter LinkFilter) []Link {
+	now := time.Now()
+	links := make([]Link, 0, len(mappings))
+	for shortCode, record := range mappings {
+		if filter.matches(shortCode, record, now) {
+			links = append(links, Link{shortCode, record})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.Before(links[j].CreatedAt)
+		}
+		return links[i].ShortCode < links[j].ShortCode
+	})
+	return links
+}
+
+// checkUpdate reports whether update can be applied to shortCode without changing anything
+func checkUpdate(mappings map[string]URLRecord, taken func(string) (bool, error), shortCode string, update LinkUpdate) error {
+	record, exists := mappings[shortCode]
+	if !exists {
+		return errLinkNotFound
+	}
+	if update.MaxClicks != nil && *update.MaxClicks > 0 && *update.MaxClicks <= record.Clicks {
+		return errClicksPassed
+	}
+	if update.NewCode != nil && *update.NewCode != shortCode {
+		if exists, _ := taken(*update.NewCode); exists {
+			return errCodeTaken
+		}
+	}
+	return nil
+}
+
+// applyUpdate changes a record that checkUpdate accepted and returns its (possibly new) code,
+// a renamed link takes its click events along
+func applyUpdate(mappings map[string]URLRecord, events map[string][]ClickEvent, shortCode string, update LinkUpdate) string {
+	record := mappings[shortCode]
+	if update.LongURL != nil {
+		record.LongURL = *update.LongURL
+	}
+	if update.ExpiresAt != nil {
+		record.ExpiresAt = *update.ExpiresAt
+	}
+	if update.NotBefore != nil {
+		record.NotBefore = *update.NotBefore
+	}
+	if update.MaxClicks != nil {
+		record.MaxClicks = *update.MaxClicks
+	}
+	if update.Options != nil {
+		record.Options = *update.Options
+	}
+	if update.NewCode != nil && *update.NewCode != shortCode {
+		delete(mappings, shortCode)
+		if moved, ok := events[shortCode]; ok {
+			delete(events, shortCode)
+			for i := range moved {
+				moved[i].ShortCode = *update.NewCode
+			}
+			events[*update.NewCode] = moved
+		}
+		shortCode = *update.NewCode
+		record.CustomName = shortCode
+	}
+	mappings[shortCode] = record
+	return shortCode
+}
+
+// archiveExpired moves every record that expired before the cutoff into archived and returns their codes
+func archiveExpired(mappings, archived map[string]URLRecord, before time.Time) []string {
+	var moved []string
+	for shortCode, record := range mappings {
+		if record.ExpiresAt.Before(before) {
+			delete(mappings, shortCode)
+			archived[shortCode] = record
+			moved = append(moved, shortCode)
+		}
+	}
+	return moved
+}
+
+// setLogo stores or, for an empty logo, removes the logo of shortCode
+func setLogo(logos map[string][]byte, shortCode string, logo []byte) {
+	if len(logo) == 0 {
+		delete(logos, shortCode)
+		return
+	}
+	logos[shortCode] = logo
+}
+
+// moveLogo makes a renamed link keep its logo
+func moveLogo(logos map[string][]byte, from, to string) {
+	if logo, ok := logos[from]; ok && from != to {
+		delete(logos, from)
+		logos[to] = logo
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLiteStore keeps links in the urls table; mappings is only a read-through cache
+type SQLiteStore struct {
+	mappings map[string]URLRecord
+	mutex    sync.RWMutex
+	db       *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{
+		mappings: make(map[string]URLRecord),
+		db:       db,
+	}
+}
+
+const urlColumns = "short_code, long_url, custom_name, not_before, expires_at, clicks, created_at, user_id, max_clicks, options"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLink(row rowScanner) (Link, error) {
+	var link Link
+	var customName sql.NullString
+	var notBefore, createdAt sql.NullTime
+	var userID sql.NullInt64
+	var options string
+	err := row.Scan(&link.ShortCode, &link.LongURL, &customName, &notBefore, &link.ExpiresAt, &link.Clicks, &createdAt, &userID, &link.MaxClicks, &options)
+	if err != nil {
+		return link, err
+	}
+	link.CustomName = customName.String
+	link.NotBefore = notBefore.Time
+	link.CreatedAt = createdAt.Time
+	link.UserID = userID.Int64
+	if err := json.Unmarshal([]byte(options), &link.Options); err != nil {
+		return link, fmt.Errorf("bad options for %s: %v", link.ShortCode, err)
+	}
+	return link, nil
+}
+
+func (store *SQLiteStore) Lookup(shortCode string) (URLRecord, bool) {
+	store.mutex.RLock()
+	record, exists := store.mappings[shortCode]
+	store.mutex.RUnlock()
+	if exists {
+		return record, true
+	}
+
+	link, err := scanLink(store.db.QueryRow("SELECT "+urlColumns+" FROM urls WHERE short_code = ?", shortCode))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Printf("Error loading URL %s: %v\n", shortCode, err)
+		}
+		return URLRecord{}, false
+	}
+
+	store.mutex.Lock()
+	store.mappings[shortCode] = link.URLRecord
+	store.mutex.Unlock()
+	return link.URLRecord, true
+}
+
+func (store *SQLiteStore) LookupArchived(shortCode string) (URLRecord, bool) {
+	link, err := scanLink(store.db.QueryRow("SELECT "+urlColumns+" FROM archived_urls WHERE short_code = ?", shortCode))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Printf("Error loading archived URL %s: %v\n", shortCode, err)
+		}
+		return URLRecord{}, false
+	}
+	return link.URLRecord, true
+}
+
+// List reads straight from the database, the cache only holds links that were looked up
+func (store *SQLiteStore) List(filter LinkFilter) ([]Link, int, error) {
+	var where []string
+	var args []any
+	if filter.Prefix != "" {
+		where = append(where, "substr(short_code, 1, ?) = ?")
+		args = append(args, len(filter.Prefix), filter.Prefix)
+	}
+	if filter.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	switch filter.State {
+	case linkStateActive:
+		where = append(where, "expires_at > ? AND (not_before IS NULL OR not_before <= ?)")
+		args = append(args, time.Now().UTC(), time.Now().UTC())
+	case linkStateExpired:
+		where = append(where, "expires_at <= ?")
+		args = append(args, time.Now().UTC())
+	case linkStateScheduled:
+		where = append(where, "not_before > ? AND expires_at > ?")
+		args = append(args, time.Now().UTC(), time.Now().UTC())
+	}
+	if !filter.CreatedAfter.IsZero() {
+		where = append(where, "created_at > ?")
+		args = append(args, filter.CreatedAfter.UTC())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.CreatedBefore.UTC())
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	table := "urls"
+	if filter.State == linkStateArchived {
+		table = "archived_urls"
+	}
+
+	var total int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM "+table+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT " + urlColumns + " FROM " + table + clause + " ORDER BY created_at, short_code"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	} else if filter.Offset > 0 {
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	links := []Link{}
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		links = append(links, link)
+	}
+	return links, total, rows.Err()
+}
+
+func (store *SQLiteStore) Update(shortCode string, update LinkUpdate) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM urls WHERE short_code = ?)", shortCode).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errLinkNotFound
+	}
+
+	if update.LongURL != nil {
+		if _, err := tx.Exec("UPDATE urls SET long_url = ? WHERE short_code = ?", *update.LongURL, shortCode); err != nil {
+			return "", err
+		}
+	}
+	if update.ExpiresAt != nil {
+		if _, err := tx.Exec("UPDATE urls SET expires_at = ? WHERE short_code = ?", update.ExpiresAt.UTC(), shortCode); err != nil {
+			return "", err
+		}
+	}
+	if update.NotBefore != nil {
+		notBefore := sql.NullTime{Time: update.NotBefore.UTC(), Valid: !update.NotBefore.IsZero()}
+		if _, err := tx.Exec("UPDATE urls SET not_before = ? WHERE short_code = ?", notBefore, shortCode); err != nil {
+			return "", err
+		}
+	}
+	if update.MaxClicks != nil {
+		// checked in the statement itself so a click landing in between cannot slip past the new limit
+		result, err := tx.Exec(
+			"UPDATE urls SET max_clicks = ? WHERE short_code = ? AND (? = 0 OR clicks < ?)",
+			*update.MaxClicks, shortCode, *update.MaxClicks, *update.MaxClicks,
+		)
+		if err != nil {
+			return "", err
+		}
+		if changed, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if changed == 0 {
+			return "", errClicksPassed
+		}
+	}
+	if update.Options != nil {
+		options, err := json.Marshal(update.Options)
+		if err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("UPDATE urls SET options = ? WHERE short_code = ?", string(options), shortCode); err != nil {
+			return "", err
+		}
+	}
+	newCode := shortCode
+	if update.NewCode != nil && *update.NewCode != shortCode {
+		newCode = *update.NewCode
+		var taken bool
+		err := tx.QueryRow(codeTakenQuery, newCode, newCode).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "", errCodeTaken
+		}
+		_, err = tx.Exec("UPDATE urls SET short_code = ?, custom_name = ? WHERE short_code = ?", newCode, newCode, shortCode)
+		if err != nil {
+			return "", err
+		}
+		// click history follows the link to its new code
+		if _, err := tx.Exec("UPDATE click_events SET short_code = ? WHERE short_code = ?", newCode, shortCode); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("UPDATE link_logos SET short_code = ? WHERE short_code = ?", newCode, shortCode); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	// drop both codes from the cache, the next Lookup reloads the fresh row
+	delete(store.mappings, shortCode)
+	delete(store.mappings, newCode)
+	return newCode, nil
+}
+
+func (store *SQLiteStore) Save(link NewLink) (string, error) {
+	return saveOne(store, link)
+}
+
+// SaveBatch inserts every link that gets a free code in one transaction, a database
+// error rolls back the whole batch
+func (store *SQLiteStore) SaveBatch(links []NewLink) ([]SaveResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	taken := func(shortCode string) (bool, error) {
+		if _, exists := store.mappings[shortCode]; exists {
+			return true, nil
+		}
+		var exists bool
+		err := tx.QueryRow(codeTakenQuery, shortCode, shortCode).Scan(&exists)
+		return exists, err
+	}
+
+	now := time.Now().UTC()
+	results := make([]SaveResult, len(links))
+	records := make(map[string]URLRecord, len(links))
+	for i, link := range links {
+		shortCode, err := pickShortCode(link.CustomName, taken)
+		if errors.Is(err, errCodeTaken) {
+			results[i].Err = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := URLRecord{
+			LongURL:    link.LongURL,
+			NotBefore:  link.NotBefore,
+			ExpiresAt:  now.Add(link.ExpiresIn),
+			CustomName: link.CustomName,
+			CreatedAt:  now,
+			UserID:     link.UserID,
+			MaxClicks:  link.MaxClicks,
+			Options:    link.Options,
+		}
+		options, err := json.Marshal(link.Options)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO urls (short_code, long_url, custom_name, not_before, expires_at, clicks, created_at, user_id, max_clicks, options) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?)",
+			shortCode, record.LongURL, sql.NullString{String: link.CustomName, Valid: link.CustomName != ""},
+			sql.NullTime{Time: link.NotBefore.UTC(), Valid: !link.NotBefore.IsZero()}, record.ExpiresAt, record.CreatedAt, sql.NullInt64{Int64: link.UserID, Valid: link.UserID != 0}, link.MaxClicks, string(options),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert url: %v", err)
+		}
+		records[shortCode] = record
+		results[i].ShortCode = shortCode
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for shortCode, record := range records {
+		store.mappings[shortCode] = record
+	}
+	return results, nil
+}
+
+// archived codes stay reserved so a new link does not inherit their click history
+const codeTakenQuery = `SELECT EXISTS(SELECT 1 FROM urls WHERE short_code = ?)
+    OR EXISTS(SELECT 1 FROM archived_urls WHERE short_code = ?)`
+
+// codeExists must be called with the mutex held
+func (store *SQLiteStore) codeExists(shortCode string) (bool, error) {
+	if _, exists := store.mappings[shortCode]; exists {
+		return true, nil
+	}
+	var exists bool
+	err := store.db.QueryRow(codeTakenQuery, shortCode, shortCode).Scan(&exists)
+	return exists, err
+}
+
+func (store *SQLiteStore) IsCustomNameAvailable(name string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	taken, err := store.codeExists(name)
+	if err != nil {
+		fmt.Printf("Error checking custom name: %v\n", err)
+		return false
+	}
+	return !taken
+}
+
+// IncrementClicks only counts a click while the link is under its limit, the guard is part of the
+// UPDATE so concurrent visits, even from another process, cannot both take the last click
+func (store *SQLiteStore) IncrementClicks(shortCode string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var clicks, maxClicks int
+	err = tx.QueryRow(
+		"UPDATE urls SET clicks = clicks + 1 WHERE short_code = ? AND (max_clicks = 0 OR clicks < max_clicks) RETURNING clicks, max_clicks",
+		shortCode,
+	).Scan(&clicks, &maxClicks)
+	if errors.Is(err, sql.ErrNoRows) {
+		delete(store.mappings, shortCode)
+		return 0, errLinkNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	usedUp := maxClicks > 0 && clicks >= maxClicks
+	if usedUp {
+		if _, err := archiveWhere(tx, "short_code = ?", shortCode); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if usedUp {
+		delete(store.mappings, shortCode)
+	} else if record, exists := store.mappings[shortCode]; exists {
+		record.Clicks = clicks
+		store.mappings[shortCode] = record
+	}
+	return clicks, nil
+}
+
+func (store *SQLiteStore) Delete(shortCode string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM urls WHERE short_code = ?", shortCode); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM link_logos WHERE short_code = ?", shortCode); err != nil {
+		return err
+	}
+	// the code is free again once deleted, so its history goes too or a new link would inherit it
+	if _, err := tx.Exec("DELETE FROM click_events WHERE short_code = ?", shortCode); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	delete(store.mappings, shortCode)
+	return nil
+}
+
+// ArchiveExpired moves links that expired before the cutoff into archived_urls,
+// their click_events rows are left alone
+func (store *SQLiteStore) ArchiveExpired(before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	moved, err := archiveWhere(tx, "expires_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for shortCode, record := range store.mappings {
+		if record.ExpiresAt.Before(before) {
+			delete(store.mappings, shortCode)
+		}
+	}
+	return moved, nil
+}
+
+// archiveWhere moves the urls rows matching condition into archived_urls and drops their logos
+func archiveWhere(tx *sql.Tx, condition string, args ...any) (int, error) {
+	_, err := tx.Exec(`
+        INSERT INTO archived_urls (user_id, short_code, long_url, custom_name, not_before, expires_at, clicks, created_at, max_clicks, options, archived_at)
+        SELECT user_id, short_code, long_url, custom_name, not_before, expires_at, clicks, created_at, max_clicks, options, ?
+        FROM urls WHERE `+condition,
+		append([]any{time.Now().UTC()}, args...)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM urls WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM link_logos WHERE short_code NOT IN (SELECT short_code FROM urls)")
+	if err != nil {
+		return 0, err
+	}
+	moved, err := result.RowsAffected()
+	return int(moved), err
+}
+
+func (store *SQLiteStore) RecordClick(event ClickEvent) error {
+	_, err := store.db.Exec(
+		"INSERT INTO click_events (short_code, clicked_at, referrer, user_agent, ip_hash, accept_language) VALUES (?, ?, ?, ?, ?, ?)",
+		event.ShortCode, event.At, event.Referrer, event.UserAgent, event.IPHash, event.AcceptLanguage,
+	)
+	return err
+}
+
+// clickedAt turns clicked_at, stored as time.Time's string form in UTC, into a value SQLite's date
+// functions accept by cutting it to "YYYY-MM-DD HH:MM:SS"
+const clickedAt = "substr(clicked_at, 1, 19)"
+
+// bucketStartSQL mirrors bucketStart; week goes back to monday, %w counts from sunday
+var bucketStartSQL = map[string]string{
+	"hour": "strftime('%Y-%m-%d %H:00:00', " + clickedAt + ")",
+	"day":  "strftime('%Y-%m-%d 00:00:00', " + clickedAt + ")",
+	"week": "strftime('%Y-%m-%d 00:00:00', " + clickedAt + ", '-' || ((strftime('%w', " + clickedAt + ") + 6) % 7) || ' days')",
+}
+
+// ClickStats aggregates in SQL so busy links don't load every event, it matches computeStats
+func (store *SQLiteStore) ClickStats(shortCode, bucket string) (clickStats, error) {
+	stats := clickStats{Code: shortCode, Bucket: bucket}
+	err := store.db.QueryRow(
+		"SELECT COUNT(*), COUNT(DISTINCT COALESCE(ip_hash, '') || '|' || COALESCE(user_agent, '')) FROM click_events WHERE short_code = ?",
+		shortCode,
+	).Scan(&stats.TotalClicks, &stats.UniqueVisitors)
+	if err != nil {
+		return clickStats{}, err
+	}
+
+	expression, ok := bucketStartSQL[bucket]
+	if !ok {
+		expression = bucketStartSQL["day"]
+	}
+	rows, err := store.db.Query(
+		"SELECT "+expression+" AS start, COUNT(*) FROM click_events WHERE short_code = ? GROUP BY start ORDER BY start",
+		shortCode,
+	)
+	if err != nil {
+		return clickStats{}, err
+	}
+	defer rows.Close()
+	stats.Buckets = make([]bucketCount, 0)
+	for rows.Next() {
+		var start string
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			return clickStats{}, err
+		}
+		at, err := time.Parse(time.DateTime, start)
+		if err != nil {
+			return clickStats{}, fmt.Errorf("bucket start %q: %w", start, err)
+		}
+		stats.Buckets = append(stats.Buckets, bucketCount{at, count})
+	}
+	if err := rows.Err(); err != nil {
+		return clickStats{}, err
+	}
+
+	stats.TopReferrers, err = store.topValues(
+		"SELECT COALESCE(NULLIF(referrer, ''), '(direct)') AS value, COUNT(*) AS hits FROM click_events WHERE short_code = ? GROUP BY value ORDER BY hits DESC, value LIMIT ?",
+		shortCode,
+	)
+	if err != nil {
+		return clickStats{}, err
+	}
+	stats.TopUserAgents, err = store.topValues(
+		"SELECT user_agent AS value, COUNT(*) AS hits FROM click_events WHERE short_code = ? AND user_agent <> '' GROUP BY value ORDER BY hits DESC, value LIMIT ?",
+		shortCode,
+	)
+	if err != nil {
+		return clickStats{}, err
+	}
+	return stats, nil
+}
+
+func (store *SQLiteStore) topValues(query, shortCode string) ([]rankedValue, error) {
+	rows, err := store.db.Query(query, shortCode, topListSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]rankedValue, 0, topListSize)
+	for rows.Next() {
+		var value rankedValue
+		if err := rows.Scan(&value.Value, &value.Count); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (store *SQLiteStore) SetLogo(shortCode string, logo []byte) error {
+	var err error
+	if len(logo) == 0 {
+		_, err = store.db.Exec("DELETE FROM link_logos WHERE short_code = ?", shortCode)
+		return err
+	}
+	result, err := store.db.Exec(`
+        INSERT INTO link_logos (short_code, image, updated_at)
+        SELECT short_code, ?, ? FROM urls WHERE short_code = ?
+        ON CONFLICT (short_code) DO UPDATE SET image = excluded.image, updated_at = excluded.updated_at`,
+		logo, time.Now().UTC(), shortCode,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errLinkNotFound
+	}
+	return nil
+}
+
+func (store *SQLiteStore) Logo(shortCode string) ([]byte, error) {
+	var logo []byte
+	err := store.db.QueryRow("SELECT image FROM link_logos WHERE short_code = ?", shortCode).Scan(&logo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return logo, err
+}
+
+// Close leaves the database open, main owns it because API keys live there too
+func (store *SQLiteStore) Close() error {
+	return nil
+}
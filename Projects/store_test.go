@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestStores returns the stores the concurrent redirects go through: one for the in-process
+// backends, two on separate connections to the same database for sqlite, like two server instances
+func openTestStores(t *testing.T, backend string) []URLStore {
+	t.Helper()
+	switch backend {
+	case "memory":
+		return []URLStore{NewMemoryStore()}
+	case "sqlite":
+		config.DBPath = filepath.Join(t.TempDir(), "urlshortener.sqlite")
+		if err := initDB(); err != nil {
+			t.Fatal(err)
+		}
+		first := db
+		if err := openDB(); err != nil {
+			t.Fatal(err)
+		}
+		second := db
+		t.Cleanup(func() {
+			first.Close()
+			second.Close()
+		})
+		return []URLStore{NewSQLiteStore(first), NewSQLiteStore(second)}
+	case "file":
+		store, err := NewFileLogStore(filepath.Join(t.TempDir(), "urlshortener.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return []URLStore{store}
+	}
+	t.Fatalf("unknown backend %q", backend)
+	return nil
+}
+
+func TestOneTimeLinkUnderConcurrentClicks(t *testing.T) {
+	const redirects = 50
+
+	for _, backend := range []string{"memory", "sqlite", "file"} {
+		t.Run(backend, func(t *testing.T) {
+			stores := openTestStores(t, backend)
+			shortCode, err := stores[0].Save(NewLink{LongURL: "https://example.com", ExpiresIn: time.Hour, MaxClicks: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, redirects)
+			for i := 0; i < redirects; i++ {
+				wg.Add(1)
+				go func(store URLStore) {
+					defer wg.Done()
+					_, err := store.IncrementClicks(shortCode)
+					errs <- err
+				}(stores[i%len(stores)])
+			}
+			wg.Wait()
+			close(errs)
+
+			served := 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					served++
+				case !errors.Is(err, errLinkNotFound):
+					t.Errorf("IncrementClicks: %v", err)
+				}
+			}
+			if served != 1 {
+				t.Errorf("served %d redirects, want exactly 1", served)
+			}
+
+			for _, store := range stores {
+				if _, exists := store.Lookup(shortCode); exists {
+					t.Errorf("link still resolves after its only click")
+				}
+				record, archived := store.LookupArchived(shortCode)
+				if !archived {
+					t.Fatalf("used up link was not archived")
+				}
+				if record.Clicks != 1 {
+					t.Errorf("archived link has %d clicks, want 1", record.Clicks)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLogStoreReopensWithLargestLogo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urlshortener.log")
+	store, err := NewFileLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortCode, err := store.Save(NewLink{LongURL: "https://example.com", ExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logo := bytes.Repeat([]byte{0xff}, maxLogoBytes)
+	if err := store.SetLogo(shortCode, logo); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileLogStore(path)
+	if err != nil {
+		t.Fatalf("reopening the log: %v", err)
+	}
+	defer store.Close()
+	got, err := store.Logo(shortCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, logo) {
+		t.Errorf("logo has %d bytes after replay, want %d", len(got), len(logo))
+	}
+}
+
+func TestFileLogStoreReplayAfterCrash(t *testing.T) {
+	tests := []struct {
+		name    string
+		tail    string // written after one saved link, as a crash mid-write would leave it
+		wantErr bool
+	}{
+		{"torn last line", `{"op":"save","code":"tor`, false},
+		{"torn last line with newline", "{\"op\":\"sa\n", false},
+		{"last line without newline", `{"op":"save","code":"nonl","long_url":"https://example.org"}`, false},
+		{"corrupt line in the middle", "not json\n" + `{"op":"delete","code":"x"}` + "\n", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "urlshortener.log")
+			store, err := NewFileLogStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := store.Save(NewLink{LongURL: "https://example.com", ExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(test.tail)
+			file.Close()
+
+			store, err = NewFileLogStore(path)
+			if test.wantErr {
+				if err == nil {
+					store.Close()
+					t.Fatal("replay accepted a corrupt entry in the middle of the log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			second, err := store.Save(NewLink{LongURL: "https://example.net", ExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			// the repaired log must also replay once more has been appended to it
+			store, err = NewFileLogStore(path)
+			if err != nil {
+				t.Fatalf("replay after the repair: %v", err)
+			}
+			defer store.Close()
+			for _, shortCode := range []string{first, second} {
+				if _, exists := store.Lookup(shortCode); !exists {
+					t.Errorf("link %s lost after the repair", shortCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type unavailablePage struct {
+	Message   string
+	LiveAt    string // pending page only, when the link goes live
+	LiveAtISO string
+}
+
+// handleUnavailable answers a visit to a link that is not live yet or no longer live: the link's
+// fallback URL when it has one, otherwise its pending or expired page
+func handleUnavailable(w http.ResponseWriter, r *http.Request, record URLRecord, expired bool) {
+	// the link changes state on its own, so no cache may hold on to this answer
+	w.Header().Set("Cache-Control", "no-store")
+
+	if expired {
+		if record.Options.ExpiredURL != "" {
+			http.Redirect(w, r, record.Options.ExpiredURL, http.StatusFound)
+			return
+		}
+		renderPageStatus(w, http.StatusGone, "expired", unavailablePage{Message: record.Options.ExpiredMessage})
+		return
+	}
+
+	if record.Options.PendingURL != "" {
+		http.Redirect(w, r, record.Options.PendingURL, http.StatusFound)
+		return
+	}
+	liveAt := record.NotBefore.UTC()
+	renderPageStatus(w, http.StatusNotFound, "pending", unavailablePage{
+		Message:   record.Options.PendingMessage,
+		LiveAt:    liveAt.Format("Mon, 2 Jan 2006 15:04 MST"),
+		LiveAtISO: liveAt.Format(time.RFC3339),
+	})
+}
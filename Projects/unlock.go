@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Protected links answer with an unlock form until the visitor sends the password. A correct password
+// sets an unlock cookie scoped to the link's path holding "<expires>.<HMAC(secret, code, hash, expires)>",
+// so it stops working when it runs out or when the owner changes the password.
+const (
+	unlockCookieName = "unlock"
+	minLinkPassword  = 4
+	maxLinkPassword  = 72 // bcrypt ignores anything longer
+)
+
+var errLinkPassword = fmt.Errorf("password must be %d to %d characters", minLinkPassword, maxLinkPassword)
+
+// hashLinkPassword hashes a new link password, an empty password means the link is not protected
+func hashLinkPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if len(password) < minLinkPassword || len(password) > maxLinkPassword {
+		return "", errLinkPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func signUnlock(shortCode, passwordHash string, expires int64) string {
+	mac := hmac.New(sha256.New, csrfKey())
+	mac.Write([]byte("unlock\x00" + shortCode + "\x00" + passwordHash + "\x00" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unlocked reports whether the request carries a live unlock cookie for this code and password
+func unlocked(r *http.Request, shortCode, passwordHash string) bool {
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != unlockCookieName {
+			continue
+		}
+		rawExpires, signature, ok := strings.Cut(cookie.Value, ".")
+		if !ok {
+			continue
+		}
+		expires, err := strconv.ParseInt(rawExpires, 10, 64)
+		if err != nil || time.Now().Unix() >= expires {
+			continue
+		}
+		if hmac.Equal([]byte(signature), []byte(signUnlock(shortCode, passwordHash, expires))) {
+			return true
+		}
+	}
+	return false
+}
+
+func setUnlockCookie(w http.ResponseWriter, r *http.Request, shortCode, passwordHash string) {
+	expires := time.Now().Add(config.UnlockTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName,
+		Value:    strconv.FormatInt(expires, 10) + "." + signUnlock(shortCode, passwordHash, expires),
+		Path:     "/" + url.PathEscape(shortCode),
+		MaxAge:   int(config.UnlockTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleUnlock shows the password form for a protected link and checks submitted passwords,
+// every attempt counts against the link's unlock limit whoever makes it
+func handleUnlock(w http.ResponseWriter, r *http.Request, shortCode, passwordHash string) {
+	page := unlockPage{Action: r.URL.RequestURI()}
+	status := http.StatusOK
+
+	if r.Method == http.MethodPost {
+		if failure := csrfFailure(r); failure != "" {
+			http.Error(w, "Forbidden: "+failure, http.StatusForbidden)
+			return
+		}
+		if !checkRateLimit(w, r, unlockLimiter, shortCode, rateLimit{}) {
+			return
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(r.PostFormValue("password")))
+		if err == nil {
+			setUnlockCookie(w, r, shortCode, passwordHash)
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			fmt.Printf("Error checking password for %s: %v\n", shortCode, err)
+		}
+		page.Error = "Wrong password"
+		status = http.StatusUnauthorized
+	}
+
+	token, err := csrfToken(w, r)
+	if err != nil {
+		fmt.Printf("Error creating CSRF token: %v\n", err)
+		http.Error(w, "Error generating response", http.StatusInternalServerError)
+		return
+	}
+	page.CSRFToken = token
+	renderPageStatus(w, status, "unlock", page)
+}